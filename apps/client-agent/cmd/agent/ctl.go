@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phd/client-agent/internal/config"
+	"github.com/phd/client-agent/internal/control"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+const ctlUsage = `Usage: phd-client-agent ctl <command>
+
+Commands:
+  status            Show the agent's status
+  pause [reason]    Pause command execution
+  resume            Resume command execution
+  poll              Check for new commands now
+  shutdown          Stop the agent
+  history [flags]   Show recorded execution results, newest first
+
+History flags:
+  --id ID           Show one command, including one still running
+  --since TIME      Only results executed at or after TIME
+  --until TIME      Only results executed before TIME
+  --status STATUS   succeeded, failed or abandoned
+  --type TYPE       script or url
+  --name NAME       Only scripts with this name
+  --digest SHA256   Only scripts with this digest
+  --limit N         Show at most N results (default 50, 0 for all)
+
+TIME is RFC 3339 (2024-05-01T12:00:00Z) or a local date (2024-05-01).
+`
+
+// runCtl sends a command to the agent running with the same configuration
+// and returns the process exit code
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	req := &control.Request{Command: args[0]}
+	switch req.Command {
+	case control.CommandStatus, control.CommandResume, control.CommandPoll, control.CommandShutdown:
+	case control.CommandPause:
+		req.Reason = strings.Join(args[1:], " ")
+	case control.CommandHistory:
+		if err := parseHistoryFlags(req, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n\n", err)
+			fmt.Fprint(os.Stderr, ctlUsage)
+			return 2
+		}
+	default:
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+
+	resp, err := control.Call(cfg.StateDir, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if os.IsPermission(err) || strings.Contains(err.Error(), "permission denied") {
+			fmt.Fprintln(os.Stderr, "The control socket is only accessible to the user running the agent; try sudo.")
+		}
+		return 1
+	}
+	if !resp.OK {
+		fmt.Fprintf(os.Stderr, "Agent refused %s: %s\n", req.Command, resp.Error)
+		return 1
+	}
+
+	if req.Command == control.CommandHistory {
+		results := resp.Results
+		if results == nil {
+			results = []*storage.ResultRecord{}
+		}
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	if resp.Status != nil {
+		out, _ := json.MarshalIndent(resp.Status, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// parseHistoryFlags fills a history request from the ctl history flags
+func parseHistoryFlags(req *control.Request, args []string) error {
+	fs := flag.NewFlagSet(control.CommandHistory, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	id := fs.String("id", "", "")
+	since := fs.String("since", "", "")
+	until := fs.String("until", "", "")
+	status := fs.String("status", "", "")
+	cmdType := fs.String("type", "", "")
+	name := fs.String("name", "", "")
+	digest := fs.String("digest", "", "")
+	limit := fs.Int("limit", 50, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	req.CommandID = *id
+	q := &storage.ResultQuery{
+		ScriptName:   *name,
+		ScriptDigest: *digest,
+		Limit:        *limit,
+	}
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+
+	switch types.CommandState(*status) {
+	case "", types.CommandStateSucceeded, types.CommandStateFailed, types.CommandStateAbandoned:
+		q.State = types.CommandState(*status)
+	default:
+		return fmt.Errorf("invalid --status %q, want succeeded, failed or abandoned", *status)
+	}
+
+	switch *cmdType {
+	case "":
+	case "script":
+		t := types.CommandTypeScript
+		q.CommandType = &t
+	case "url":
+		t := types.CommandTypeURL
+		q.CommandType = &t
+	default:
+		return fmt.Errorf("invalid --type %q, want script or url", *cmdType)
+	}
+
+	req.Query = q
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or a local date; "" is the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
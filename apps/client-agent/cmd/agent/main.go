@@ -6,13 +6,25 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/phd/client-agent/internal/agent"
 	"github.com/phd/client-agent/internal/blockchain"
 	"github.com/phd/client-agent/internal/config"
+	"github.com/phd/client-agent/internal/control"
 	"github.com/phd/client-agent/internal/executor"
+	"github.com/phd/client-agent/internal/heartbeat"
+	"github.com/phd/client-agent/internal/keystore"
 	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/reporter"
+	"github.com/phd/client-agent/internal/signing"
+	"github.com/phd/client-agent/internal/source"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/internal/sysinfo"
 	"github.com/phd/client-agent/pkg/types"
 )
 
@@ -21,6 +33,16 @@ const (
 )
 
 func main() {
+	// Operate a running agent through its control socket
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
+	// Apply rlimits to a script, then exec it; started by the executor
+	if len(os.Args) > 1 && os.Args[1] == executor.LimitedCommand {
+		os.Exit(executor.RunLimited(os.Args[2:]))
+	}
+
 	// Check and request root privileges if needed
 	if err := ensureRootPrivileges(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to obtain root privileges: %v\n", err)
@@ -42,6 +64,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
 		os.Exit(1)
 	}
+	if err := logger.InitAudit(cfg.AuditLogFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize audit log: %v\n", err)
+		os.Exit(1)
+	}
 
 	logger.Log.WithFields(map[string]interface{}{
 		"version":  version,
@@ -56,61 +82,136 @@ func main() {
 		logger.Log.WithError(err).Fatal("Failed to create executor")
 	}
 	defer exec.Cleanup()
+	exec.SetKillGrace(cfg.KillGracePeriod)
+	exec.SetLimits(cfg.ScriptLimits)
+
+	// Require signed commands when a trust store is configured
+	var verifier *signing.Verifier
+	if cfg.TrustStore != "" {
+		trustStore, err := signing.NewTrustStore(cfg.TrustStore)
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Failed to load trust store")
+		}
+		verifier = signing.NewVerifier(trustStore, cfg.SignatureMaxAge)
+		exec.SetVerifier(verifier)
+	} else {
+		logger.Log.Warn("TRUST_STORE not set, command signatures will not be verified")
+	}
 
-	// Create blockchain poller
-	poller, err := blockchain.NewPoller(cfg.RPCURL, cfg.ContractAddress, cfg.PollingInterval)
+	// Drop privileges for scripts
+	if err := exec.SetRunAs(cfg.RunAsUser, cfg.RunAsGroup, cfg.ElevatedScripts); err != nil {
+		logger.Log.WithError(err).Fatal("Failed to set script user")
+	}
+	if cfg.RunAsUser == "" && runtime.GOOS != "windows" {
+		logger.Log.Warn("RUN_AS_USER not set, scripts will run with the agent's privileges")
+	}
+
+	// Refuse to run next to another agent using the same state
+	lock, err := control.AcquireLock(cfg.StateDir)
 	if err != nil {
-		logger.Log.WithError(err).Fatal("Failed to create blockchain poller")
-	}
-	defer poller.Close()
-
-	// Set command handler
-	poller.SetCommandHandler(func(cmd *types.Command) error {
-		logger.Log.WithFields(map[string]interface{}{
-			"commandId":   cmd.ID.String(),
-			"commandType": cmd.CommandType,
-			"dataLength":  len(cmd.Data),
-		}).Info("Processing new command")
-
-		// Execute command
-		result := exec.Execute(cmd)
-
-		// Log result
-		if result.Success {
-			logger.Log.WithFields(map[string]interface{}{
-				"commandId": result.CommandID.String(),
-				"duration":  result.Duration,
-				"output":    truncate(result.Output, 200),
-			}).Info("Command executed successfully")
-		} else {
-			logger.Log.WithFields(map[string]interface{}{
-				"commandId": result.CommandID.String(),
-				"duration":  result.Duration,
-				"error":     result.Error,
-			}).Error("Command execution failed")
+		logger.Log.WithError(err).Fatal("Failed to lock state directory")
+	}
+	defer lock.Release()
+
+	// Initialize storage
+	if cfg.StateKeySource == types.KeySourceFile {
+		if err := keystore.Relocate(filepath.Join(cfg.DataDir, "state.key"), cfg.StateKeyFile); err != nil {
+			logger.Log.WithError(err).Fatal("Failed to move state encryption key")
 		}
+		if rel, err := filepath.Rel(cfg.DataDir, cfg.StateKeyFile); err == nil && !strings.HasPrefix(rel, "..") {
+			logger.Log.WithField("file", cfg.StateKeyFile).Warn("STATE_KEY_FILE is inside DATA_DIR, anyone who can edit the state can also read its key")
+		}
+	}
+	stateKey, err := keystore.Load(cfg.StateKeySource, cfg.StateKeyFile)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to load state encryption key")
+	}
+	store, err := storage.NewStorage(cfg.StateDir, stateKey)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to create storage")
+	}
+	defer store.Close()
+	store.SetRetention(cfg.HistoryMaxAge, cfg.HistoryMaxCount)
+	if removed, err := store.PruneResults(); err != nil {
+		logger.Log.WithError(err).Warn("Failed to prune execution history")
+	} else if removed > 0 {
+		logger.Log.WithField("removed", removed).Info("Pruned execution history")
+	}
+	exec.SetStateRecorder(store)
+	if verifier != nil {
+		verifier.SetReplayGuard(store)
+	}
 
-		return nil
-	})
+	// JSON-RPC endpoints shared by the poller and on-chain acknowledgements
+	var rpc *blockchain.MultiClient
+	if cfg.CommandSource == types.CommandSourceRPC || cfg.AckContractAddress != "" {
+		rpc, err = blockchain.NewMultiClient(cfg.RPCURLs, cfg.MaxHeadLag, cfg.HeadCheckInterval)
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Failed to connect to RPC")
+		}
+		defer rpc.Close()
+	}
+
+	// Create command source
+	src, err := newCommandSource(cfg, store, rpc)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to create command source")
+	}
+	defer src.Stop()
 
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Check for latest unexecuted command on startup
-	logger.Log.Info("Checking for pending commands from previous session...")
-	if err := poller.CheckLatestUnexecutedCommand(ctx); err != nil {
-		logger.Log.WithError(err).Warn("Failed to check for latest unexecuted command")
-	}
-
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start poller in goroutine
+	// Create agent
+	info := sysinfo.Collect(cfg.ClientID)
+	a := agent.New(cfg, info, src, exec, store)
+
+	// Setup result reporting
+	reporters, err := newReporters(cfg, store, rpc)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to create result reporter")
+	}
+	defer reporters.Close()
+	if len(reporters) > 0 {
+		reporters.Start(ctx)
+		a.SetReporter(reporters)
+	}
+
+	// Start heartbeat
+	if cfg.HeartbeatURL != "" {
+		hb := heartbeat.NewSender(cfg.HeartbeatURL, cfg.ReportSecret, cfg.HeartbeatInterval, info, version, store)
+		for _, r := range reporters {
+			if h, ok := r.(*reporter.HTTPReporter); ok {
+				hb.SetOutbox(h)
+			}
+		}
+		go hb.Run(ctx)
+	}
+
+	// Serve the control socket
+	shutdownC := make(chan struct{}, 1)
+	ctlServer := control.NewServer(cfg.StateDir, a, version, func() {
+		select {
+		case shutdownC <- struct{}{}:
+		default:
+		}
+	})
+	if err := ctlServer.Start(ctx); err != nil {
+		logger.Log.WithError(err).Warn("Control socket unavailable")
+	}
+	defer ctlServer.Close()
+
+	// Start agent in goroutine
 	errChan := make(chan error, 1)
+	done := make(chan struct{})
 	go func() {
-		if err := poller.Start(ctx); err != nil {
+		defer close(done)
+		if err := a.Run(ctx); err != nil {
 			errChan <- err
 		}
 	}()
@@ -121,13 +222,23 @@ func main() {
 	select {
 	case <-sigChan:
 		logger.Log.Info("Shutdown signal received")
+	case <-shutdownC:
+		logger.Log.Info("Shutdown requested over control socket")
 	case err := <-errChan:
-		logger.Log.WithError(err).Error("Poller error")
+		logger.Log.WithError(err).Error("Agent error")
 	}
 
 	// Graceful shutdown
 	logger.Log.Info("Shutting down...")
 	cancel()
+
+	// Let a running script be terminated and its result recorded before the
+	// deferred cleanups remove its files and close the state
+	select {
+	case <-done:
+	case <-time.After(exec.ShutdownTimeout()):
+		logger.Log.Warn("Agent did not stop in time, exiting anyway")
+	}
 	logger.Log.Info("Shutdown complete")
 }
 
@@ -141,11 +252,37 @@ func printBanner() {
 	fmt.Printf(banner, version)
 }
 
-func truncate(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
+// newReporters creates the configured result reporters
+func newReporters(cfg *types.Config, store *storage.Storage, rpc *blockchain.MultiClient) (reporter.Multi, error) {
+	var reporters reporter.Multi
+
+	if cfg.ReportURL != "" {
+		outbox, err := reporter.NewOutbox(filepath.Join(store.Dir(), "outbox"), cfg.OutboxMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, reporter.NewHTTPReporter(cfg.ReportURL, cfg.ReportSecret, cfg.ClientID, cfg.ReportOutputLimit, outbox))
+	}
+
+	if cfg.AckContractAddress != "" {
+		chainReporter, err := reporter.NewChainReporter(rpc, cfg.AckContractAddress, cfg.AckPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, chainReporter)
+	}
+
+	return reporters, nil
+}
+
+// newCommandSource creates the command source selected by COMMAND_SOURCE
+func newCommandSource(cfg *types.Config, store *storage.Storage, rpc *blockchain.MultiClient) (source.CommandSource, error) {
+	switch cfg.CommandSource {
+	case types.CommandSourceFile:
+		return source.NewDirSource(cfg.CommandDir, cfg.PollingInterval)
+	default:
+		return blockchain.NewPoller(cfg, store, rpc)
 	}
-	return s[:maxLen] + "..."
 }
 
 // ensureRootPrivileges checks if running as root and re-executes with sudo if needed
@@ -0,0 +1,617 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/phd/client-agent/internal/executor"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/reporter"
+	"github.com/phd/client-agent/internal/signing"
+	"github.com/phd/client-agent/internal/source"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/internal/targeting"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// Agent runs the execute pipeline: it consumes commands from a CommandSource,
+// executes the ones that have not run yet and records them in storage
+type Agent struct {
+	source   source.CommandSource
+	executor *executor.Executor
+	storage  *storage.Storage
+
+	backfillPolicy    types.BackfillPolicy
+	backfillMaxAge    time.Duration
+	reconcileInterval time.Duration
+	reconciled        bool
+	// missing holds IDs already reported absent from the source
+	missing           map[string]bool
+	interruptedPolicy types.InterruptedPolicy
+
+	triggerAllowlist []string
+	adminAddresses   []string
+	matcher          *targeting.Matcher
+	reporter         reporter.Reporter
+
+	// identity reports static fields of the agent's status
+	identity  types.AgentStatus
+	startedAt time.Time
+	pollC     chan struct{}
+}
+
+// adminPausePrefix marks pauses caused by an unexpected admin change, which
+// are lifted once the new admin is listed in ADMIN_ADDRESSES
+const adminPausePrefix = "contract admin changed"
+
+// reportTimeout bounds how long result reporting may hold up the pipeline
+const reportTimeout = 2 * time.Minute
+
+// New creates an agent
+func New(cfg *types.Config, info *types.ClientInfo, src source.CommandSource, exec *executor.Executor, store *storage.Storage) *Agent {
+	return &Agent{
+		source:   src,
+		executor: exec,
+		storage:  store,
+
+		backfillPolicy:    cfg.BackfillPolicy,
+		backfillMaxAge:    cfg.BackfillMaxAge,
+		reconcileInterval: cfg.ReconcileInterval,
+		interruptedPolicy: cfg.InterruptedPolicy,
+
+		triggerAllowlist: cfg.TriggerAllowlist,
+		adminAddresses:   cfg.AdminAddresses,
+		matcher:          targeting.NewMatcher(info, cfg.Tags),
+
+		identity: types.AgentStatus{
+			ClientID:        info.ClientID,
+			Source:          cfg.CommandSource,
+			Network:         cfg.Network,
+			ContractAddress: cfg.ContractAddress,
+		},
+		missing:   make(map[string]bool),
+		startedAt: time.Now(),
+		pollC:     make(chan struct{}, 1),
+	}
+}
+
+// SetReporter sets where execution results are reported
+func (a *Agent) SetReporter(r reporter.Reporter) {
+	a.reporter = r
+}
+
+// Run starts the source, catches up on commands missed while the agent was
+// not running, then executes streamed commands until ctx is cancelled
+func (a *Agent) Run(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- a.source.Start(ctx)
+	}()
+
+	// Admin changes are only reported by contract-backed sources
+	var adminC <-chan *types.AdminChange
+	if watcher, ok := a.source.(source.AdminWatcher); ok {
+		adminC = watcher.AdminChanges()
+		if err := a.checkAdmin(ctx, watcher); err != nil {
+			logger.Log.WithError(err).Warn("Failed to check contract admin")
+		}
+	}
+
+	// Settle commands the previous session left unfinished
+	if err := a.recoverInFlight(ctx); err != nil {
+		logger.Log.WithError(err).Warn("Failed to recover unfinished commands")
+	}
+
+	// Catch up on commands missed while the agent was not running
+	logger.Log.Info("Checking for pending commands from previous session...")
+	if err := a.ReconcileCommands(ctx); err != nil {
+		logger.Log.WithError(err).Warn("Failed to reconcile missed commands")
+	}
+
+	// A nil channel never fires, which disables periodic reconciliation
+	var reconcileC <-chan time.Time
+	if a.reconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(a.reconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcileC = reconcileTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errChan:
+			if err == nil && ctx.Err() == nil {
+				err = fmt.Errorf("command source stopped unexpectedly")
+			}
+			return err
+		case cmd := <-a.source.Commands():
+			if err := a.handleCommand(ctx, cmd); err != nil {
+				logger.Log.WithError(err).WithField("commandId", cmd.ID.String()).Error("Failed to handle command")
+			}
+		case change := <-adminC:
+			if err := a.handleAdminChange(change); err != nil {
+				logger.Log.WithError(err).Error("Failed to handle admin change")
+			}
+		case <-reconcileC:
+			if err := a.ReconcileCommands(ctx); err != nil {
+				logger.Log.WithError(err).Error("Reconciliation failed")
+			}
+		case <-a.pollC:
+			if err := a.ReconcileCommands(ctx); err != nil {
+				logger.Log.WithError(err).Error("Reconciliation failed")
+			}
+		}
+	}
+}
+
+// Status returns a snapshot of the agent
+func (a *Agent) Status() *types.AgentStatus {
+	status := a.identity
+	status.StartedAt = a.startedAt
+	status.PauseReason = a.storage.PauseReason()
+	status.LastCommandID = a.storage.GetLastCommandID().String()
+	status.LastBlock, _ = a.storage.GetLastBlock()
+	if inFlight, err := a.storage.InFlight(); err == nil {
+		status.InFlight = len(inFlight)
+	}
+	if depth, ok := a.reporter.(interface{ Depth() (int, int64) }); ok {
+		status.PendingReports, _ = depth.Depth()
+	}
+	return &status
+}
+
+// Pause stops command execution until Resume is called. New commands are
+// deferred, not dropped.
+func (a *Agent) Pause(reason string) error {
+	logger.Log.WithField("reason", reason).Warn("Execution paused by operator")
+	return a.storage.Pause(reason)
+}
+
+// Resume lifts any pause, including one caused by an admin change or a
+// failed integrity check, and runs the commands deferred meanwhile
+func (a *Agent) Resume() error {
+	reason := a.storage.PauseReason()
+	if reason == "" {
+		return nil
+	}
+	if err := a.storage.Resume(); err != nil {
+		return err
+	}
+	logger.Log.WithField("reason", reason).Info("Execution resumed by operator")
+	a.Poll()
+	return nil
+}
+
+// Poll makes the source check for new commands and reconciles missed ones
+// right away
+func (a *Agent) Poll() {
+	if trigger, ok := a.source.(source.PollTrigger); ok {
+		trigger.PollNow()
+	}
+	select {
+	case a.pollC <- struct{}{}:
+	default:
+	}
+}
+
+// History returns the recorded results matching q, newest first
+func (a *Agent) History(q storage.ResultQuery) ([]*storage.ResultRecord, error) {
+	return a.storage.QueryResults(q)
+}
+
+// Result returns the recorded result of a command. A command still in
+// flight is returned with its state only; nil means it is unknown.
+func (a *Agent) Result(commandID string) (*storage.ResultRecord, error) {
+	id, ok := new(big.Int).SetString(commandID, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid command id %q", commandID)
+	}
+	record, err := a.storage.GetResult(id)
+	if record != nil || err != nil {
+		return record, err
+	}
+	state, err := a.storage.GetState(id)
+	if state == "" || err != nil {
+		return nil, err
+	}
+	return &storage.ResultRecord{CommandID: id.String(), State: state}, nil
+}
+
+// handleCommand executes a streamed command unless it already ran
+func (a *Agent) handleCommand(ctx context.Context, cmd *types.Command) error {
+	if a.storage.IsExecuted(cmd.ID) {
+		logger.Log.WithField("commandId", cmd.ID.String()).Debug("Command already executed, skipping")
+		return nil
+	}
+
+	// Paused commands stay unexecuted and are picked up by reconciliation
+	// once execution resumes
+	if reason := a.storage.PauseReason(); reason != "" {
+		logger.Log.WithFields(map[string]interface{}{
+			"commandId": cmd.ID.String(),
+			"reason":    reason,
+		}).Warn("Execution paused, deferring command")
+		return nil
+	}
+
+	return a.executeCommand(ctx, cmd)
+}
+
+// executeCommand runs a command and records its result
+func (a *Agent) executeCommand(ctx context.Context, cmd *types.Command) error {
+	if !a.isTrustedTrigger(cmd.TriggeredBy) {
+		logger.Audit("command_rejected", map[string]interface{}{
+			"commandId":        cmd.ID.String(),
+			"backendCommandId": cmd.BackendCommandID,
+			"triggeredBy":      cmd.TriggeredBy,
+			"reason":           "triggeredBy not in TRIGGER_ALLOWLIST",
+		})
+		return a.storage.MarkExecuted(cmd.ID)
+	}
+
+	// Unwrap the command envelope, if any
+	if err := signing.Open(cmd); err != nil {
+		logger.Log.WithError(err).WithField("commandId", cmd.ID.String()).Error("Rejecting malformed command")
+		return a.storage.MarkExecuted(cmd.ID)
+	}
+
+	// Commands aimed at other clients are recorded so they are not revisited
+	if ok, reason := a.matcher.Match(cmd.Target()); !ok {
+		logger.Log.WithFields(map[string]interface{}{
+			"commandId":        cmd.ID.String(),
+			"backendCommandId": cmd.BackendCommandID,
+			"reason":           reason,
+		}).Info("Command not targeted at this client, skipping")
+		return a.storage.MarkExecuted(cmd.ID)
+	}
+
+	if err := a.storage.SetState(cmd.ID, types.CommandStateReceived); err != nil {
+		return err
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"commandId":        cmd.ID.String(),
+		"commandType":      cmd.CommandType,
+		"backendCommandId": cmd.BackendCommandID,
+		"signed":           cmd.Envelope != nil && cmd.Envelope.Signature != "",
+		"dataLength":       len(cmd.Data),
+	}).Info("Processing new command")
+
+	// Execute command
+	result := a.executor.Execute(ctx, cmd)
+
+	// A command cut short by shutdown stays in flight, so the next start
+	// settles it according to INTERRUPTED_COMMAND_POLICY
+	if result.State == types.CommandStateAbandoned {
+		return ctx.Err()
+	}
+
+	// Log result
+	if result.Success {
+		logger.Log.WithFields(map[string]interface{}{
+			"commandId": result.CommandID.String(),
+			"duration":  result.Duration,
+			"output":    truncate(result.Output, 200),
+		}).Info("Command executed successfully")
+	} else {
+		logger.Log.WithFields(map[string]interface{}{
+			"commandId": result.CommandID.String(),
+			"duration":  result.Duration,
+			"error":     result.Error,
+			"limitsHit": result.LimitsHit,
+		}).Error("Command execution failed")
+	}
+
+	a.report(ctx, result)
+
+	return a.storage.RecordResult(result)
+}
+
+// recoverInFlight settles commands that were received but never finished,
+// because the agent crashed or was stopped. Commands whose script never
+// started are executed again. Commands caught running may have had side
+// effects, so they are re-run only under the rerun policy and otherwise
+// recorded as abandoned and reported as failed.
+func (a *Agent) recoverInFlight(ctx context.Context) error {
+	entries, err := a.storage.InFlight()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if entry.State == types.CommandStateRunning && a.interruptedPolicy != types.InterruptedRerun {
+			if err := a.abandon(ctx, entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if reason := a.storage.PauseReason(); reason != "" {
+			// Left in flight, so the next start retries it
+			continue
+		}
+
+		command, err := a.source.GetCommand(ctx, entry.CommandID)
+		if err != nil {
+			return fmt.Errorf("failed to get command %s: %w", entry.CommandID, err)
+		}
+
+		logger.Log.WithFields(map[string]interface{}{
+			"commandId": entry.CommandID.String(),
+			"state":     entry.State,
+		}).Warn("Re-running command left unfinished by the previous session")
+		if err := a.executeCommand(ctx, command); err != nil {
+			return fmt.Errorf("failed to execute command %s: %w", entry.CommandID, err)
+		}
+	}
+
+	return nil
+}
+
+// abandon records an interrupted command as failed without running it again
+func (a *Agent) abandon(ctx context.Context, entry *storage.StateEntry) error {
+	result := &types.ExecutionResult{
+		CommandID:  entry.CommandID,
+		State:      types.CommandStateAbandoned,
+		Success:    false,
+		ExitCode:   -1,
+		Error:      "agent stopped while the command was running",
+		ExecutedAt: entry.UpdatedAt,
+	}
+
+	logger.Audit("command_abandoned", map[string]interface{}{
+		"commandId": entry.CommandID.String(),
+		"since":     entry.UpdatedAt,
+	})
+	logger.Log.WithField("commandId", entry.CommandID.String()).Warn("Command was interrupted while running, marking it abandoned")
+
+	a.report(ctx, result)
+
+	return a.storage.RecordResult(result)
+}
+
+// ReconcileCommands walks every command ID between the executed watermark
+// and the latest command of the source, executing the ones that were missed
+// according to the configured backfill policy. Delivery therefore does not
+// depend on CommandTriggered events having been observed, and a command that
+// failed to process is retried even after later commands ran.
+func (a *Agent) ReconcileCommands(ctx context.Context) error {
+	// Catch state edited while the agent runs, not only at startup
+	if err := a.storage.CheckIntegrity(); err != nil {
+		return err
+	}
+
+	// The admin may have changed in blocks the source has not reported yet
+	if watcher, ok := a.source.(source.AdminWatcher); ok {
+		if _, _, err := a.verifyAdmin(ctx, watcher); err != nil {
+			return fmt.Errorf("failed to check contract admin: %w", err)
+		}
+	}
+
+	if reason := a.storage.PauseReason(); reason != "" {
+		logger.Log.WithField("reason", reason).Debug("Execution paused, skipping reconciliation")
+		return nil
+	}
+
+	// Get latest command ID from contract
+	latestID, err := a.source.LatestCommandID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get latest command ID: %w", err)
+	}
+
+	firstPass := !a.reconciled
+	a.reconciled = true
+
+	// If no commands exist
+	if latestID.Sign() == 0 {
+		logger.Log.Debug("No commands found in source")
+		return nil
+	}
+
+	// If this is the first run, just mark as executed without running
+	if firstPass && a.storage.IsFirstRun() {
+		logger.Log.WithField("commandId", latestID.String()).Info("First run detected - marking latest command as executed without running")
+		return a.storage.MarkExecutedThrough(latestID)
+	}
+
+	localID := a.storage.ExecutedWatermark()
+	if localID.Cmp(latestID) >= 0 {
+		logger.Log.WithField("commandId", latestID.String()).Debug("No missed commands")
+		return nil
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"localCommandId":  localID.String(),
+		"latestCommandId": latestID.String(),
+		"policy":          a.backfillPolicy,
+	}).Info("Reconciling missed commands")
+
+	one := big.NewInt(1)
+	for id := new(big.Int).Add(localID, one); id.Cmp(latestID) <= 0; id.Add(id, one) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		commandID := new(big.Int).Set(id)
+		if a.storage.IsExecuted(commandID) {
+			continue
+		}
+
+		command, err := a.source.GetCommand(ctx, commandID)
+		if errors.Is(err, source.ErrNotFound) {
+			// A source without every ID, e.g. a command directory with a
+			// gap, must not hold back the commands after it. Nothing is
+			// recorded, so the ID still runs if it shows up later.
+			entry := logger.Log.WithField("commandId", commandID.String())
+			if a.missing[commandID.String()] {
+				entry.Debug("Missed command still not found in source, skipping")
+			} else {
+				a.missing[commandID.String()] = true
+				entry.Warn("Missed command not found in source, skipping")
+			}
+			continue
+		}
+		if err != nil {
+			// Stop here so the gap is retried on the next pass
+			return fmt.Errorf("failed to get command %s: %w", commandID, err)
+		}
+
+		if reason := a.skipReason(command, latestID); reason != "" {
+			logger.Log.WithFields(map[string]interface{}{
+				"commandId": commandID.String(),
+				"reason":    reason,
+			}).Info("Skipping missed command per backfill policy")
+			if err := a.storage.MarkExecuted(commandID); err != nil {
+				return fmt.Errorf("failed to mark command %s as skipped: %w", commandID, err)
+			}
+			continue
+		}
+
+		logger.Log.WithField("commandId", commandID.String()).Info("Found unexecuted command, executing now")
+		if err := a.executeCommand(ctx, command); err != nil {
+			return fmt.Errorf("failed to execute command %s: %w", commandID, err)
+		}
+	}
+
+	return nil
+}
+
+// skipReason reports why the backfill policy excludes a missed command, or ""
+// if the command should be executed
+func (a *Agent) skipReason(command *types.Command, latestID *big.Int) string {
+	switch a.backfillPolicy {
+	case types.BackfillLatest:
+		if command.ID.Cmp(latestID) < 0 {
+			return "superseded by a newer command"
+		}
+	case types.BackfillMaxAge:
+		if command.Timestamp == nil {
+			return ""
+		}
+		issuedAt := time.Unix(command.Timestamp.Int64(), 0)
+		if time.Since(issuedAt) > a.backfillMaxAge {
+			return fmt.Sprintf("older than %v", a.backfillMaxAge)
+		}
+	}
+	return ""
+}
+
+// report hands a result to the reporter; delivery failures are logged and
+// never block recording the command as executed
+func (a *Agent) report(ctx context.Context, result *types.ExecutionResult) {
+	if a.reporter == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	if err := a.reporter.Report(ctx, result); err != nil {
+		logger.Log.WithError(err).WithField("commandId", result.CommandID.String()).Error("Failed to report result")
+	}
+}
+
+// isTrustedTrigger reports whether a command's sender may trigger commands.
+// Every sender is trusted when no allowlist is configured.
+func (a *Agent) isTrustedTrigger(triggeredBy string) bool {
+	if len(a.triggerAllowlist) == 0 {
+		return true
+	}
+	return containsAddress(a.triggerAllowlist, triggeredBy)
+}
+
+// handleAdminChange pauses execution when the admin moves to an address that
+// the operator has not listed in ADMIN_ADDRESSES
+func (a *Agent) handleAdminChange(change *types.AdminChange) error {
+	fields := map[string]interface{}{
+		"oldAdmin": change.OldAdmin,
+		"newAdmin": change.NewAdmin,
+		"block":    change.Block,
+		"txHash":   change.TxHash,
+	}
+
+	if containsAddress(a.adminAddresses, change.NewAdmin) {
+		logger.Audit("admin_updated", fields)
+		return nil
+	}
+
+	logger.Audit("admin_updated_unexpected", fields)
+	return a.pauseForAdmin(fmt.Sprintf("%s from %s to %s at block %d", adminPausePrefix, change.OldAdmin, change.NewAdmin, change.Block))
+}
+
+// checkAdmin compares the current admin with ADMIN_ADDRESSES on startup. It
+// pauses execution if the admin is unexpected, and lifts an earlier admin
+// pause once the operator has confirmed the new admin by listing it.
+func (a *Agent) checkAdmin(ctx context.Context, watcher source.AdminWatcher) error {
+	if len(a.adminAddresses) == 0 {
+		return nil
+	}
+
+	current, listed, err := a.verifyAdmin(ctx, watcher)
+	if err != nil || !listed {
+		return err
+	}
+
+	if reason := a.storage.PauseReason(); strings.HasPrefix(reason, adminPausePrefix) {
+		logger.Audit("admin_change_confirmed", map[string]interface{}{
+			"admin":       current,
+			"pauseReason": reason,
+		})
+		return a.storage.Resume()
+	}
+	return nil
+}
+
+// verifyAdmin pauses execution if the current admin is not in
+// ADMIN_ADDRESSES. AdminUpdated events lag behind by CONFIRMATIONS, so
+// reconciliation checks the admin itself before running anything.
+func (a *Agent) verifyAdmin(ctx context.Context, watcher source.AdminWatcher) (string, bool, error) {
+	if len(a.adminAddresses) == 0 {
+		return "", true, nil
+	}
+
+	current, err := watcher.CurrentAdmin(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !containsAddress(a.adminAddresses, current) {
+		logger.Audit("admin_unexpected", map[string]interface{}{"admin": current})
+		return current, false, a.pauseForAdmin(fmt.Sprintf("%s to %s, which is not in ADMIN_ADDRESSES", adminPausePrefix, current))
+	}
+	return current, true, nil
+}
+
+func (a *Agent) pauseForAdmin(reason string) error {
+	if err := a.storage.Pause(reason); err != nil {
+		return err
+	}
+	logger.Log.WithField("reason", reason).Error("Command execution paused until an operator confirms the new admin by adding it to ADMIN_ADDRESSES and restarting")
+	return nil
+}
+
+// containsAddress reports whether addr is in list, ignoring checksum case
+func containsAddress(list []string, addr string) bool {
+	for _, a := range list {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "..."
+}
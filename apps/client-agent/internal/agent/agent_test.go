@@ -0,0 +1,413 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/phd/client-agent/internal/executor"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/source"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+const (
+	trustedSender = "0x1111111111111111111111111111111111111111"
+	otherSender   = "0x2222222222222222222222222222222222222222"
+	listedAdmin   = "0x3333333333333333333333333333333333333333"
+	unknownAdmin  = "0x4444444444444444444444444444444444444444"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	if err := logger.InitAudit(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testAgent is an agent over a MemorySource and fresh storage
+type testAgent struct {
+	*Agent
+	src   *source.MemorySource
+	store *storage.Storage
+}
+
+// newTestAgent creates a test agent. A previous session that handled every
+// command up to seed is simulated unless seed is 0, which makes it a first run.
+func newTestAgent(t *testing.T, cfg *types.Config, seed int64) *testAgent {
+	t.Helper()
+
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	if seed > 0 {
+		store, err := storage.NewStorage(dir, key)
+		if err != nil {
+			t.Fatalf("NewStorage: %v", err)
+		}
+		if err := store.MarkExecutedThrough(big.NewInt(seed)); err != nil {
+			t.Fatalf("MarkExecutedThrough: %v", err)
+		}
+		store.Close()
+	}
+
+	store, err := storage.NewStorage(dir, key)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	exec, err := executor.NewExecutor(30*time.Second, 1)
+	if err != nil {
+		t.Fatalf("NewExecutor: %v", err)
+	}
+	t.Cleanup(func() { exec.Cleanup() })
+	exec.SetStateRecorder(store)
+
+	if cfg.BackfillPolicy == "" {
+		cfg.BackfillPolicy = types.BackfillAll
+	}
+	if cfg.InterruptedPolicy == "" {
+		cfg.InterruptedPolicy = types.InterruptedAbandon
+	}
+	info := &types.ClientInfo{ClientID: "lab-01", OS: "linux", Hostname: "lab-01"}
+
+	src := source.NewMemorySource()
+	t.Cleanup(src.Stop)
+
+	return &testAgent{
+		Agent: New(cfg, info, src, exec, store),
+		src:   src,
+		store: store,
+	}
+}
+
+// command returns a plain script command that prints "ok"
+func command(id int64) *types.Command {
+	return &types.Command{
+		ID:          big.NewInt(id),
+		CommandType: types.CommandTypeScript,
+		Data:        base64.StdEncoding.EncodeToString([]byte("echo ok\n")),
+		Timestamp:   big.NewInt(time.Now().Unix()),
+		TriggeredBy: trustedSender,
+	}
+}
+
+// targetedCommand wraps a command's script in an unsigned envelope aimed at target
+func targetedCommand(t *testing.T, id int64, target *types.Target) *types.Command {
+	t.Helper()
+
+	cmd := command(id)
+	cmd.BackendCommandID = "backend-" + cmd.ID.String()
+	payload, err := json.Marshal(&types.Payload{
+		BackendCommandID: cmd.BackendCommandID,
+		CommandType:      cmd.CommandType,
+		Data:             cmd.Data,
+		Timestamp:        cmd.Timestamp.Int64(),
+		Target:           target,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := json.Marshal(&types.Envelope{Version: 1, Payload: base64.StdEncoding.EncodeToString(payload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Data = string(env)
+	return cmd
+}
+
+// ran reports whether a command was executed rather than skipped
+func (ta *testAgent) ran(t *testing.T, id int64) bool {
+	t.Helper()
+	record, err := ta.store.GetResult(big.NewInt(id))
+	if err != nil {
+		t.Fatalf("GetResult(%d): %v", id, err)
+	}
+	if record == nil {
+		return false
+	}
+	if !record.Success {
+		t.Fatalf("command %d failed: %s", id, record.Error)
+	}
+	return true
+}
+
+// expect checks which commands ran; every command must be marked executed
+func (ta *testAgent) expect(t *testing.T, ran map[int64]bool) {
+	t.Helper()
+	for id, want := range ran {
+		if !ta.store.IsExecuted(big.NewInt(id)) {
+			t.Errorf("command %d not marked executed", id)
+		}
+		if got := ta.ran(t, id); got != want {
+			t.Errorf("command %d ran = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestFirstRunMarksExistingCommands(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{}, 0)
+	for id := int64(1); id <= 3; id++ {
+		ta.src.Add(command(id))
+	}
+
+	if err := ta.ReconcileCommands(context.Background()); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	// Earlier commands are left below the watermark without running
+	for id := int64(1); id <= 3; id++ {
+		if ta.ran(t, id) {
+			t.Errorf("command %d ran on the first run", id)
+		}
+	}
+	if got := ta.store.ExecutedWatermark(); got.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("watermark = %s, want 3", got)
+	}
+
+	// Commands issued after the first run are executed
+	ta.src.Add(command(4))
+	if err := ta.ReconcileCommands(context.Background()); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	ta.expect(t, map[int64]bool{4: true})
+}
+
+func TestBackfillPolicies(t *testing.T) {
+	tests := []struct {
+		policy types.BackfillPolicy
+		ran    map[int64]bool
+	}{
+		{types.BackfillAll, map[int64]bool{2: true, 3: true, 4: true}},
+		{types.BackfillLatest, map[int64]bool{2: false, 3: false, 4: true}},
+		{types.BackfillMaxAge, map[int64]bool{2: false, 3: true, 4: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			ta := newTestAgent(t, &types.Config{BackfillPolicy: tt.policy, BackfillMaxAge: time.Hour}, 1)
+
+			old := command(2)
+			old.Timestamp = big.NewInt(time.Now().Add(-2 * time.Hour).Unix())
+			ta.src.Add(old)
+			ta.src.Add(command(3))
+			ta.src.Add(command(4))
+
+			if err := ta.ReconcileCommands(context.Background()); err != nil {
+				t.Fatalf("ReconcileCommands: %v", err)
+			}
+			ta.expect(t, tt.ran)
+		})
+	}
+}
+
+func TestReconcileSkipsMissingCommands(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{}, 1)
+	ta.src.Add(command(3))
+
+	if err := ta.ReconcileCommands(context.Background()); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	ta.expect(t, map[int64]bool{3: true})
+	if ta.store.IsExecuted(big.NewInt(2)) {
+		t.Fatal("missing command 2 recorded as executed")
+	}
+	if got := ta.store.ExecutedWatermark(); got.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("watermark = %s, want 1", got)
+	}
+
+	// The missing command still runs once the source has it
+	ta.src.Add(command(2))
+	if err := ta.ReconcileCommands(context.Background()); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	ta.expect(t, map[int64]bool{2: true, 3: true})
+	if got := ta.store.ExecutedWatermark(); got.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("watermark = %s, want 3", got)
+	}
+}
+
+func TestAdminPauseDefersUntilResume(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{AdminAddresses: []string{listedAdmin}}, 1)
+	ctx := context.Background()
+
+	// A transfer to a listed admin does not pause
+	if err := ta.handleAdminChange(&types.AdminChange{OldAdmin: listedAdmin, NewAdmin: listedAdmin}); err != nil {
+		t.Fatalf("handleAdminChange: %v", err)
+	}
+	if reason := ta.store.PauseReason(); reason != "" {
+		t.Fatalf("paused for a listed admin: %s", reason)
+	}
+
+	if err := ta.handleAdminChange(&types.AdminChange{OldAdmin: listedAdmin, NewAdmin: unknownAdmin}); err != nil {
+		t.Fatalf("handleAdminChange: %v", err)
+	}
+	if reason := ta.store.PauseReason(); reason == "" {
+		t.Fatal("not paused after a transfer to an unknown admin")
+	}
+
+	// Streamed and missed commands are deferred, not dropped
+	cmd := command(2)
+	ta.src.Add(cmd)
+	if err := ta.handleCommand(ctx, cmd); err != nil {
+		t.Fatalf("handleCommand: %v", err)
+	}
+	if err := ta.ReconcileCommands(ctx); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	if ta.store.IsExecuted(cmd.ID) {
+		t.Fatal("command executed while paused")
+	}
+
+	if err := ta.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if err := ta.ReconcileCommands(ctx); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	ta.expect(t, map[int64]bool{2: true})
+}
+
+// adminSource is a MemorySource whose contract admin can be changed without
+// the change being reported yet, like a poller that lags behind
+type adminSource struct {
+	*source.MemorySource
+	admin string
+}
+
+func (s *adminSource) AdminChanges() <-chan *types.AdminChange { return nil }
+
+func (s *adminSource) CurrentAdmin(ctx context.Context) (string, error) {
+	return s.admin, nil
+}
+
+func TestReconcileChecksAdminBeforeRunning(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{AdminAddresses: []string{listedAdmin}}, 1)
+	src := &adminSource{MemorySource: ta.src, admin: listedAdmin}
+	ta.source = src
+	ctx := context.Background()
+
+	ta.src.Add(command(2))
+	if err := ta.ReconcileCommands(ctx); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	ta.expect(t, map[int64]bool{2: true})
+
+	// The new admin's command is not run before its AdminUpdated event arrives
+	src.admin = unknownAdmin
+	ta.src.Add(command(3))
+	if err := ta.ReconcileCommands(ctx); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	if ta.store.IsExecuted(big.NewInt(3)) {
+		t.Fatal("command executed under an unknown admin")
+	}
+	if reason := ta.store.PauseReason(); reason == "" {
+		t.Fatal("not paused for an unknown admin")
+	}
+
+	// Reconciliation does not lift the pause when the admin is transferred back
+	src.admin = listedAdmin
+	if err := ta.ReconcileCommands(ctx); err != nil {
+		t.Fatalf("ReconcileCommands: %v", err)
+	}
+	if ta.store.IsExecuted(big.NewInt(3)) {
+		t.Fatal("command executed before the operator resumed")
+	}
+}
+
+func TestRejectsUntrustedAndUntargetedCommands(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{TriggerAllowlist: []string{trustedSender}}, 0)
+	ctx := context.Background()
+
+	untrusted := command(1)
+	untrusted.TriggeredBy = otherSender
+	untargeted := targetedCommand(t, 2, &types.Target{ClientIDs: []string{"lab-02"}})
+	targeted := targetedCommand(t, 3, &types.Target{ClientIDs: []string{"lab-01"}, OS: []string{"linux"}})
+
+	for _, cmd := range []*types.Command{untrusted, untargeted, targeted} {
+		if err := ta.handleCommand(ctx, cmd); err != nil {
+			t.Fatalf("handleCommand(%s): %v", cmd.ID, err)
+		}
+	}
+	ta.expect(t, map[int64]bool{1: false, 2: false, 3: true})
+}
+
+func TestSettlesInterruptedCommands(t *testing.T) {
+	tests := []struct {
+		policy types.InterruptedPolicy
+		state  types.CommandState
+		want   types.CommandState
+	}{
+		{types.InterruptedAbandon, types.CommandStateRunning, types.CommandStateAbandoned},
+		{types.InterruptedRerun, types.CommandStateRunning, types.CommandStateSucceeded},
+		{types.InterruptedAbandon, types.CommandStateReceived, types.CommandStateSucceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+string(tt.state), func(t *testing.T) {
+			ta := newTestAgent(t, &types.Config{InterruptedPolicy: tt.policy}, 1)
+			ta.src.Add(command(2))
+			if err := ta.store.SetState(big.NewInt(2), tt.state); err != nil {
+				t.Fatalf("SetState: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- ta.Run(ctx) }()
+
+			record := waitForResult(t, ta.store, 2)
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if record.State != tt.want {
+				t.Errorf("state = %s, want %s", record.State, tt.want)
+			}
+			if inFlight, err := ta.store.InFlight(); err != nil || len(inFlight) != 0 {
+				t.Errorf("still in flight: %v, %v", inFlight, err)
+			}
+		})
+	}
+}
+
+func TestRunExecutesStreamedCommands(t *testing.T) {
+	ta := newTestAgent(t, &types.Config{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ta.Run(ctx)
+
+	if err := ta.src.Push(ctx, command(2)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if record := waitForResult(t, ta.store, 2); !record.Success {
+		t.Errorf("command failed: %s", record.Error)
+	}
+}
+
+// waitForResult waits until a command's result has been recorded
+func waitForResult(t *testing.T, store *storage.Storage, id int64) *storage.ResultRecord {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		record, err := store.GetResult(big.NewInt(id))
+		if err != nil {
+			t.Fatalf("GetResult: %v", err)
+		}
+		if record != nil {
+			return record
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no result for command %d", id)
+	return nil
+}
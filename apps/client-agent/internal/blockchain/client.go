@@ -0,0 +1,388 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/phd/client-agent/internal/logger"
+)
+
+const (
+	// latencyWeight and errorWeight smooth the per-endpoint moving averages
+	latencyWeight = 0.3
+	errorWeight   = 0.2
+
+	// failuresBeforeCooldown consecutive failures take an endpoint out of
+	// rotation for endpointCooldown
+	failuresBeforeCooldown = 3
+	endpointCooldown       = 30 * time.Second
+)
+
+// endpoint tracks one RPC provider and its health
+type endpoint struct {
+	url    string
+	client *ethclient.Client
+
+	mu                  sync.Mutex
+	latency             time.Duration // moving average of successful calls
+	errorRate           float64       // moving average, 0 (healthy) to 1
+	consecutiveFailures int
+	cooldownUntil       time.Time
+	head                uint64
+	lagging             bool
+}
+
+// score ranks endpoints; lower is better
+func (e *endpoint) score() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := float64(e.latency) * (1 + 10*e.errorRate)
+	if e.lagging {
+		s += float64(time.Hour)
+	}
+	if time.Now().Before(e.cooldownUntil) {
+		s += 2 * float64(time.Hour)
+	}
+	return s
+}
+
+func (e *endpoint) recordSuccess(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(e.latency))
+	}
+	e.errorRate *= 1 - errorWeight
+	e.consecutiveFailures = 0
+}
+
+func (e *endpoint) recordFailure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.errorRate = errorWeight + (1-errorWeight)*e.errorRate
+	e.consecutiveFailures++
+	if e.consecutiveFailures >= failuresBeforeCooldown {
+		e.cooldownUntil = time.Now().Add(endpointCooldown)
+	}
+}
+
+// MultiClient spreads RPC calls over several endpoints, preferring the
+// healthiest one and failing over transparently when a call errors
+type MultiClient struct {
+	endpoints         []*endpoint
+	maxHeadLag        uint64
+	headCheckInterval time.Duration
+
+	mu            sync.Mutex
+	lastHeadCheck time.Time
+}
+
+// NewMultiClient dials every RPC URL; it fails only if none can be dialed
+func NewMultiClient(rpcURLs []string, maxHeadLag uint64, headCheckInterval time.Duration) (*MultiClient, error) {
+	mc := &MultiClient{
+		maxHeadLag:        maxHeadLag,
+		headCheckInterval: headCheckInterval,
+	}
+
+	var lastErr error
+	for _, url := range rpcURLs {
+		client, err := ethclient.Dial(url)
+		if err != nil {
+			logger.Log.WithError(err).WithField("rpc", url).Warn("Failed to connect to RPC endpoint")
+			lastErr = err
+			continue
+		}
+		mc.endpoints = append(mc.endpoints, &endpoint{url: url, client: client})
+	}
+
+	if len(mc.endpoints) == 0 {
+		return nil, fmt.Errorf("failed to connect to any RPC endpoint: %w", lastErr)
+	}
+
+	return mc, nil
+}
+
+// ranked returns the endpoints ordered from healthiest to least healthy
+func (mc *MultiClient) ranked() []*endpoint {
+	ranked := make([]*endpoint, len(mc.endpoints))
+	copy(ranked, mc.endpoints)
+	scores := make(map[*endpoint]float64, len(ranked))
+	for _, e := range ranked {
+		scores[e] = e.score()
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] < scores[ranked[j]]
+	})
+	return ranked
+}
+
+// call runs fn against each endpoint in rank order until one succeeds
+func (mc *MultiClient) call(ctx context.Context, op string, fn func(*ethclient.Client) error) error {
+	var lastErr error
+	for _, e := range mc.ranked() {
+		start := time.Now()
+		err := fn(e.client)
+		if err == nil {
+			e.recordSuccess(time.Since(start))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		lastErr = err
+		// Errors about the request itself would fail on every endpoint and
+		// say nothing about the provider's health
+		if isRequestError(err) {
+			return err
+		}
+
+		e.recordFailure()
+		if len(mc.endpoints) > 1 {
+			logger.Log.WithError(err).WithFields(map[string]interface{}{
+				"rpc": e.url,
+				"op":  op,
+			}).Warn("RPC call failed, failing over")
+		}
+	}
+	return lastErr
+}
+
+// BlockNumber returns the current head block. Every headCheckInterval, the
+// head is queried from all endpoints so that lagging nodes are demoted.
+func (mc *MultiClient) BlockNumber(ctx context.Context) (uint64, error) {
+	mc.mu.Lock()
+	checkHeads := len(mc.endpoints) > 1 && time.Since(mc.lastHeadCheck) >= mc.headCheckInterval
+	if checkHeads {
+		mc.lastHeadCheck = time.Now()
+	}
+	mc.mu.Unlock()
+
+	if checkHeads {
+		if head, err := mc.crossCheckHeads(ctx); err == nil {
+			return head, nil
+		}
+	}
+
+	var head uint64
+	err := mc.call(ctx, "BlockNumber", func(c *ethclient.Client) error {
+		var err error
+		head, err = c.BlockNumber(ctx)
+		return err
+	})
+	return head, err
+}
+
+// crossCheckHeads queries every endpoint's head concurrently, flags the ones
+// more than maxHeadLag blocks behind the highest, and returns the head of the
+// best-ranked endpoint that is not lagging
+func (mc *MultiClient) crossCheckHeads(ctx context.Context) (uint64, error) {
+	var wg sync.WaitGroup
+	for _, e := range mc.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			start := time.Now()
+			head, err := e.client.BlockNumber(ctx)
+			if err != nil {
+				e.recordFailure()
+				return
+			}
+			e.recordSuccess(time.Since(start))
+			e.mu.Lock()
+			e.head = head
+			e.mu.Unlock()
+		}(e)
+	}
+	wg.Wait()
+
+	var maxHead uint64
+	for _, e := range mc.endpoints {
+		e.mu.Lock()
+		if e.head > maxHead {
+			maxHead = e.head
+		}
+		e.mu.Unlock()
+	}
+	if maxHead == 0 {
+		return 0, errors.New("no endpoint returned a head block")
+	}
+
+	for _, e := range mc.endpoints {
+		e.mu.Lock()
+		wasLagging := e.lagging
+		e.lagging = maxHead-e.head > mc.maxHeadLag
+		if e.lagging && !wasLagging {
+			logger.Log.WithFields(map[string]interface{}{
+				"rpc":     e.url,
+				"head":    e.head,
+				"maxHead": maxHead,
+			}).Warn("RPC endpoint is lagging behind other providers")
+		} else if wasLagging && !e.lagging {
+			logger.Log.WithField("rpc", e.url).Info("RPC endpoint caught up")
+		}
+		e.mu.Unlock()
+	}
+
+	best := mc.ranked()[0]
+	best.mu.Lock()
+	defer best.mu.Unlock()
+	if best.lagging || best.head == 0 {
+		return maxHead, nil
+	}
+	return best.head, nil
+}
+
+// FilterLogs runs a log query with failover
+func (mc *MultiClient) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]ethtypes.Log, error) {
+	var logs []ethtypes.Log
+	err := mc.call(ctx, "FilterLogs", func(c *ethclient.Client) error {
+		var err error
+		logs, err = c.FilterLogs(ctx, query)
+		return err
+	})
+	return logs, err
+}
+
+// CallContract executes a read-only contract call with failover
+func (mc *MultiClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	var result []byte
+	err := mc.call(ctx, "CallContract", func(c *ethclient.Client) error {
+		var err error
+		result, err = c.CallContract(ctx, msg, blockNumber)
+		return err
+	})
+	return result, err
+}
+
+// ChainID returns the chain ID used to sign transactions
+func (mc *MultiClient) ChainID(ctx context.Context) (*big.Int, error) {
+	var id *big.Int
+	err := mc.call(ctx, "ChainID", func(c *ethclient.Client) error {
+		var err error
+		id, err = c.ChainID(ctx)
+		return err
+	})
+	return id, err
+}
+
+// PendingNonceAt returns the next nonce of an account, counting pending transactions
+func (mc *MultiClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	var nonce uint64
+	err := mc.call(ctx, "PendingNonceAt", func(c *ethclient.Client) error {
+		var err error
+		nonce, err = c.PendingNonceAt(ctx, account)
+		return err
+	})
+	return nonce, err
+}
+
+// SuggestGasPrice returns the gas price for a timely transaction
+func (mc *MultiClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	var price *big.Int
+	err := mc.call(ctx, "SuggestGasPrice", func(c *ethclient.Client) error {
+		var err error
+		price, err = c.SuggestGasPrice(ctx)
+		return err
+	})
+	return price, err
+}
+
+// EstimateGas estimates the gas a transaction needs
+func (mc *MultiClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	var gas uint64
+	err := mc.call(ctx, "EstimateGas", func(c *ethclient.Client) error {
+		var err error
+		gas, err = c.EstimateGas(ctx, msg)
+		return err
+	})
+	return gas, err
+}
+
+// SendTransaction submits a signed transaction with failover. Resending a
+// signed transaction to another endpoint cannot apply it twice.
+func (mc *MultiClient) SendTransaction(ctx context.Context, tx *ethtypes.Transaction) error {
+	return mc.call(ctx, "SendTransaction", func(c *ethclient.Client) error {
+		return c.SendTransaction(ctx, tx)
+	})
+}
+
+// BlockHash returns the hash the RPC node reports for a block. The hash field
+// is read as-is rather than recomputed from the header, since Hedera's relay
+// does not return headers that hash back to the reported value.
+func (mc *MultiClient) BlockHash(ctx context.Context, number uint64) (common.Hash, error) {
+	var block struct {
+		Hash common.Hash `json:"hash"`
+	}
+	err := mc.call(ctx, "BlockHash", func(c *ethclient.Client) error {
+		block.Hash = common.Hash{}
+		if err := c.Client().CallContext(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+			return err
+		}
+		if block.Hash == (common.Hash{}) {
+			return fmt.Errorf("block %d not found", number)
+		}
+		return nil
+	})
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	return block.Hash, nil
+}
+
+// SubscribeFilterLogs subscribes through the healthiest WebSocket endpoint
+func (mc *MultiClient) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- ethtypes.Log) (ethereum.Subscription, error) {
+	var lastErr error = rpc.ErrNotificationsUnsupported
+	for _, e := range mc.ranked() {
+		if !isWebSocketURL(e.url) {
+			continue
+		}
+		sub, err := e.client.SubscribeFilterLogs(ctx, query, ch)
+		if err == nil {
+			return sub, nil
+		}
+		lastErr = err
+		logger.Log.WithError(err).WithField("rpc", e.url).Debug("Failed to subscribe on endpoint")
+	}
+	return nil, lastErr
+}
+
+// SupportsSubscriptions reports whether any endpoint can serve eth_subscribe
+func (mc *MultiClient) SupportsSubscriptions() bool {
+	for _, e := range mc.endpoints {
+		if isWebSocketURL(e.url) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes every endpoint connection
+func (mc *MultiClient) Close() {
+	for _, e := range mc.endpoints {
+		e.client.Close()
+	}
+}
+
+// isRequestError reports whether err is caused by the request rather than
+// the endpoint serving it
+func isRequestError(err error) bool {
+	return (isRangeError(err) && !isRateLimitError(err)) || strings.Contains(strings.ToLower(err.Error()), "execution reverted")
+}
@@ -0,0 +1,322 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/phd/client-agent/internal/logger"
+)
+
+// mirrorPageLimit is the largest page size the Mirror Node accepts
+const mirrorPageLimit = 100
+
+// MirrorClient reads blocks, contract logs and contract calls from the Hedera
+// Mirror Node REST API instead of the JSON-RPC relay. Block ranges are
+// translated to consensus timestamp ranges, which the Mirror Node paginates
+// reliably over long historical windows.
+type MirrorClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewMirrorClient creates a Mirror Node client for the given base URL
+func NewMirrorClient(baseURL string) *MirrorClient {
+	return &MirrorClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type mirrorTimestampRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type mirrorBlock struct {
+	Number    uint64               `json:"number"`
+	Hash      string               `json:"hash"`
+	Timestamp mirrorTimestampRange `json:"timestamp"`
+}
+
+type mirrorLog struct {
+	Address          string   `json:"address"`
+	BlockHash        string   `json:"block_hash"`
+	BlockNumber      uint64   `json:"block_number"`
+	Data             string   `json:"data"`
+	Index            uint     `json:"index"`
+	Topics           []string `json:"topics"`
+	TransactionHash  string   `json:"transaction_hash"`
+	TransactionIndex uint     `json:"transaction_index"`
+}
+
+type mirrorLinks struct {
+	Next string `json:"next"`
+}
+
+// BlockNumber returns the newest block known to the Mirror Node
+func (mc *MirrorClient) BlockNumber(ctx context.Context) (uint64, error) {
+	var resp struct {
+		Blocks []mirrorBlock `json:"blocks"`
+	}
+	if err := mc.get(ctx, "/api/v1/blocks?order=desc&limit=1", &resp); err != nil {
+		return 0, err
+	}
+	if len(resp.Blocks) == 0 {
+		return 0, fmt.Errorf("mirror node returned no blocks")
+	}
+	return resp.Blocks[0].Number, nil
+}
+
+// BlockHash returns the EVM-compatible hash of a block
+func (mc *MirrorClient) BlockHash(ctx context.Context, number uint64) (common.Hash, error) {
+	block, err := mc.block(ctx, number)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return evmHash(block.Hash), nil
+}
+
+func (mc *MirrorClient) block(ctx context.Context, number uint64) (*mirrorBlock, error) {
+	var block mirrorBlock
+	if err := mc.get(ctx, fmt.Sprintf("/api/v1/blocks/%d", number), &block); err != nil {
+		return nil, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	return &block, nil
+}
+
+// FilterLogs returns the logs of a single contract in a block range, paging
+// through the Mirror Node by consensus timestamp
+func (mc *MirrorClient) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]ethtypes.Log, error) {
+	if len(query.Addresses) != 1 || query.FromBlock == nil || query.ToBlock == nil {
+		return nil, fmt.Errorf("mirror node log queries need exactly one address and a block range")
+	}
+
+	// The Mirror Node matches a single value per topic position, so query
+	// each event signature separately and merge in chain order
+	if len(query.Topics) > 0 && len(query.Topics[0]) > 1 {
+		var logs []ethtypes.Log
+		for _, topic := range query.Topics[0] {
+			single := query
+			single.Topics = append([][]common.Hash{{topic}}, query.Topics[1:]...)
+			part, err := mc.FilterLogs(ctx, single)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, part...)
+		}
+		sort.SliceStable(logs, func(i, j int) bool {
+			if logs[i].BlockNumber != logs[j].BlockNumber {
+				return logs[i].BlockNumber < logs[j].BlockNumber
+			}
+			return logs[i].Index < logs[j].Index
+		})
+		return logs, nil
+	}
+
+	fromBlock, err := mc.block(ctx, query.FromBlock.Uint64())
+	if err != nil {
+		return nil, err
+	}
+	toBlock, err := mc.block(ctx, query.ToBlock.Uint64())
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("timestamp", "gte:"+fromBlock.Timestamp.From)
+	params.Add("timestamp", "lte:"+toBlock.Timestamp.To)
+	params.Set("order", "asc")
+	params.Set("limit", fmt.Sprint(mirrorPageLimit))
+	for i, topics := range query.Topics {
+		if len(topics) == 1 {
+			params.Set(fmt.Sprintf("topic%d", i), topics[0].Hex())
+		} else if len(topics) > 1 {
+			return nil, fmt.Errorf("mirror node log queries support one value per topic")
+		}
+	}
+
+	path := fmt.Sprintf("/api/v1/contracts/%s/results/logs?%s", query.Addresses[0].Hex(), params.Encode())
+
+	var logs []ethtypes.Log
+	for path != "" {
+		var resp struct {
+			Logs  []mirrorLog `json:"logs"`
+			Links mirrorLinks `json:"links"`
+		}
+		if err := mc.get(ctx, path, &resp); err != nil {
+			return nil, fmt.Errorf("failed to get contract logs: %w", err)
+		}
+
+		for _, l := range resp.Logs {
+			vLog, err := l.toLog()
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, vLog)
+		}
+		path = resp.Links.Next
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"from":  fromBlock.Timestamp.From,
+		"to":    toBlock.Timestamp.To,
+		"count": len(logs),
+	}).Debug("Fetched logs from mirror node")
+
+	return logs, nil
+}
+
+func (l mirrorLog) toLog() (ethtypes.Log, error) {
+	data, err := hexutil.Decode(emptyHex(l.Data))
+	if err != nil {
+		return ethtypes.Log{}, fmt.Errorf("invalid log data: %w", err)
+	}
+
+	topics := make([]common.Hash, 0, len(l.Topics))
+	for _, t := range l.Topics {
+		topics = append(topics, common.HexToHash(t))
+	}
+
+	return ethtypes.Log{
+		Address:     common.HexToAddress(l.Address),
+		Topics:      topics,
+		Data:        data,
+		BlockNumber: l.BlockNumber,
+		BlockHash:   evmHash(l.BlockHash),
+		TxHash:      evmHash(l.TransactionHash),
+		TxIndex:     l.TransactionIndex,
+		Index:       l.Index,
+	}, nil
+}
+
+// CallContract executes a read-only call through the Mirror Node's EVM
+// simulation endpoint. Only the latest state can be queried.
+func (mc *MirrorClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if msg.To == nil {
+		return nil, fmt.Errorf("mirror node contract calls need a target address")
+	}
+	if blockNumber != nil {
+		return nil, fmt.Errorf("mirror node contract calls only support the latest block")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"to":       msg.To.Hex(),
+		"data":     hexutil.Encode(msg.Data),
+		"block":    "latest",
+		"estimate": false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal call: %w", err)
+	}
+
+	var resp struct {
+		Result string `json:"result"`
+	}
+	if err := mc.do(ctx, http.MethodPost, "/api/v1/contracts/call", bytes.NewReader(body), &resp); err != nil {
+		return nil, fmt.Errorf("failed to call contract: %w", err)
+	}
+
+	return hexutil.Decode(emptyHex(resp.Result))
+}
+
+// SubscribeFilterLogs is not available over REST
+func (mc *MirrorClient) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- ethtypes.Log) (ethereum.Subscription, error) {
+	return nil, rpc.ErrNotificationsUnsupported
+}
+
+// SupportsSubscriptions always reports false for the Mirror Node
+func (mc *MirrorClient) SupportsSubscriptions() bool {
+	return false
+}
+
+// Close releases idle HTTP connections
+func (mc *MirrorClient) Close() {
+	mc.httpClient.CloseIdleConnections()
+}
+
+func (mc *MirrorClient) get(ctx context.Context, path string, out interface{}) error {
+	return mc.do(ctx, http.MethodGet, path, nil, out)
+}
+
+func (mc *MirrorClient) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, mc.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := mc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mirror node returned status %d: %s", resp.StatusCode, mirrorErrorMessage(data))
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// mirrorErrorMessage extracts the messages from a Mirror Node error body
+func mirrorErrorMessage(body []byte) string {
+	var resp struct {
+		Status struct {
+			Messages []struct {
+				Message string `json:"message"`
+			} `json:"messages"`
+		} `json:"_status"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Status.Messages) == 0 {
+		return strings.TrimSpace(string(body))
+	}
+
+	msgs := make([]string, 0, len(resp.Status.Messages))
+	for _, m := range resp.Status.Messages {
+		msgs = append(msgs, m.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// evmHash converts a Mirror Node hash to a 32-byte EVM hash. Hedera block
+// hashes are 48 bytes; like the JSON-RPC relay, keep the first 32.
+func evmHash(h string) common.Hash {
+	h = strings.TrimPrefix(h, "0x")
+	if len(h) > 2*common.HashLength {
+		h = h[:2*common.HashLength]
+	}
+	return common.HexToHash(h)
+}
+
+// emptyHex normalises an empty hex string so hexutil.Decode accepts it
+func emptyHex(h string) string {
+	if h == "" {
+		return "0x"
+	}
+	return h
+}
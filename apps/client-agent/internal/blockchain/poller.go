@@ -2,16 +2,18 @@ package blockchain
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/phd/client-agent/internal/logger"
 	"github.com/phd/client-agent/internal/storage"
 	"github.com/phd/client-agent/pkg/types"
@@ -19,13 +21,61 @@ import (
 
 // Poller polls blockchain for new command events
 type Poller struct {
-	client          *ethclient.Client
+	client          chainClient
+	closeClient     bool // the client is the poller's own, not shared
 	contract        common.Address
 	contractABI     abi.ABI
 	pollingInterval time.Duration
 	lastBlock       uint64
-	commandHandler  func(*types.Command) error
+	lastBlockHash   common.Hash
 	storage         *storage.Storage
+	commands        chan *types.Command
+	adminChanges    chan *types.AdminChange
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+
+	// chunkSize is the current FilterLogs range, halved on range errors and
+	// grown back up to maxChunkSize on success
+	chunkSize    uint64
+	maxChunkSize uint64
+
+	// confirmations is how far behind the head a block must be before its
+	// events are processed; reorgRewind is how far to step back when the
+	// checkpoint block turns out to have been reorganized away, never more
+	// than maxCatchup blocks
+	confirmations uint64
+	reorgRewind   uint64
+	maxCatchup    uint64
+
+	// subscribe enables WebSocket log subscriptions; while one is live the
+	// ticker only polls every subscriptionPollInterval as a safety net
+	subscribe                bool
+	subscribed               atomic.Bool
+	subscriptionPollInterval time.Duration
+
+	// wake triggers an immediate poll, from a subscription or PollNow
+	wake chan struct{}
+
+	// rateLimitBackoff grows while the RPC keeps rate limiting; no poll runs
+	// before rateLimitedUntil
+	rateLimitBackoff time.Duration
+	rateLimitedUntil time.Time
+}
+
+// maxRateLimitBackoff caps the wait between polls while rate limited
+const maxRateLimitBackoff = 5 * time.Minute
+
+// chainClient is the chain access the poller needs, served either by JSON-RPC
+// endpoints (MultiClient) or by the Hedera Mirror Node (MirrorClient)
+type chainClient interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	BlockHash(ctx context.Context, number uint64) (common.Hash, error)
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]ethtypes.Log, error)
+	CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- ethtypes.Log) (ethereum.Subscription, error)
+	SupportsSubscriptions() bool
+	Close()
 }
 
 // DeviceControl ABI (from smart contract)
@@ -284,14 +334,31 @@ const deviceControlABI = `[
 ]
 `
 
-// NewPoller creates a new blockchain poller
-func NewPoller(rpcURL, contractAddress string, pollingInterval time.Duration) (*Poller, error) {
-	// Connect to RPC
-	client, err := ethclient.Dial(rpcURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
+// NewPoller creates a new blockchain poller. It implements
+// source.CommandSource, streaming each new command on Commands. In RPC mode
+// the poller reads through rpc, which stays owned by the caller.
+func NewPoller(cfg *types.Config, store *storage.Storage, rpc *MultiClient) (*Poller, error) {
+	// Connect to the command source
+	var client chainClient
+	var closeClient bool
+	switch cfg.CommandSource {
+	case types.CommandSourceMirror:
+		logger.Log.WithField("mirrorNode", cfg.MirrorNodeURL).Info("Using Hedera Mirror Node as command source")
+		client = NewMirrorClient(cfg.MirrorNodeURL)
+		closeClient = true
+	default:
+		if rpc == nil {
+			return nil, fmt.Errorf("no RPC client for command source %s", cfg.CommandSource)
+		}
+		client = rpc
 	}
 
+	return newPoller(cfg, store, client, closeClient)
+}
+
+// newPoller creates a poller reading through client, resuming from the
+// checkpoint in store
+func newPoller(cfg *types.Config, store *storage.Storage, client chainClient, closeClient bool) (*Poller, error) {
 	// Parse ABI
 	contractABI, err := abi.JSON(strings.NewReader(deviceControlABI))
 	if err != nil {
@@ -306,95 +373,456 @@ func NewPoller(rpcURL, contractAddress string, pollingInterval time.Duration) (*
 		return nil, fmt.Errorf("failed to get current block: %w", err)
 	}
 
-	// Initialize storage
-	store, err := storage.NewStorage()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create storage: %w", err)
+	// Resume from the checkpoint, keeping its hash only if it is used as-is so
+	// the first poll can detect a reorg that happened while we were down
+	checkpoint, checkpointHash := store.GetLastBlock()
+	lastBlock := startBlock(checkpoint, safeHead(currentBlock, cfg.Confirmations), cfg.MaxCatchupBlocks)
+	var lastBlockHash common.Hash
+	if lastBlock == checkpoint && checkpointHash != "" {
+		lastBlockHash = common.HexToHash(checkpointHash)
 	}
 
 	return &Poller{
 		client:          client,
-		contract:        common.HexToAddress(contractAddress),
+		closeClient:     closeClient,
+		contract:        common.HexToAddress(cfg.ContractAddress),
 		contractABI:     contractABI,
-		pollingInterval: pollingInterval,
-		lastBlock:       currentBlock,
+		pollingInterval: cfg.PollingInterval,
+		lastBlock:       lastBlock,
+		lastBlockHash:   lastBlockHash,
 		storage:         store,
+		commands:        make(chan *types.Command),
+		adminChanges:    make(chan *types.AdminChange),
+
+		chunkSize:    cfg.LogChunkSize,
+		maxChunkSize: cfg.LogChunkSize,
+
+		confirmations: cfg.Confirmations,
+		reorgRewind:   cfg.ReorgRewindBlocks,
+		maxCatchup:    cfg.MaxCatchupBlocks,
+
+		subscribe:                client.SupportsSubscriptions(),
+		subscriptionPollInterval: cfg.SubscriptionPollInterval,
+
+		wake: make(chan struct{}, 1),
 	}, nil
 }
 
-// SetCommandHandler sets the handler for new commands
-func (p *Poller) SetCommandHandler(handler func(*types.Command) error) {
-	p.commandHandler = handler
+// safeHead returns the newest block with at least the given number of
+// confirmations on top of it
+func safeHead(currentBlock, confirmations uint64) uint64 {
+	if currentBlock < confirmations {
+		return 0
+	}
+	return currentBlock - confirmations
+}
+
+// startBlock picks the block to resume from: the persisted checkpoint when
+// there is one, clamped so that at most maxCatchup blocks are replayed.
+func startBlock(checkpoint, currentBlock, maxCatchup uint64) uint64 {
+	if checkpoint == 0 {
+		logger.Log.WithField("block", currentBlock).Info("No block checkpoint found, starting from current block")
+		return currentBlock
+	}
+
+	if checkpoint > currentBlock {
+		logger.Log.WithFields(map[string]interface{}{
+			"checkpoint": checkpoint,
+			"current":    currentBlock,
+		}).Warn("Block checkpoint is ahead of the chain, starting from current block")
+		return currentBlock
+	}
+
+	if maxCatchup > 0 && currentBlock-checkpoint > maxCatchup {
+		logger.Log.WithFields(map[string]interface{}{
+			"checkpoint": checkpoint,
+			"current":    currentBlock,
+			"maxCatchup": maxCatchup,
+		}).Warn("Block checkpoint is older than the catch-up window, skipping older blocks")
+		return currentBlock - maxCatchup
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"checkpoint": checkpoint,
+		"current":    currentBlock,
+	}).Info("Resuming from block checkpoint")
+	return checkpoint
+}
+
+// Commands streams commands from newly observed CommandTriggered events
+func (p *Poller) Commands() <-chan *types.Command {
+	return p.commands
+}
+
+// AdminChanges streams AdminUpdated events emitted by the contract
+func (p *Poller) AdminChanges() <-chan *types.AdminChange {
+	return p.adminChanges
 }
 
 // Start starts polling for events
 func (p *Poller) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	p.mu.Lock()
+	p.cancel = cancel
+	p.mu.Unlock()
+	defer cancel()
+
 	logger.Log.WithField("interval", p.pollingInterval).Info("Starting blockchain poller")
 
 	ticker := time.NewTicker(p.pollingInterval)
 	defer ticker.Stop()
 
+	// Subscription events only wake the loop; logs are still read through
+	// poll so that chunking, confirmations and checkpoints apply unchanged
+	if p.subscribe {
+		go p.subscribeLoop(ctx, p.wake)
+	}
+
+	var lastPoll time.Time
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Log.Info("Stopping blockchain poller")
 			return nil
 		case <-ticker.C:
-			if err := p.poll(ctx); err != nil {
-				logger.Log.WithError(err).Error("Polling failed")
+			if p.subscriptionActive() && time.Since(lastPoll) < p.subscriptionPollInterval {
+				continue
 			}
+			lastPoll = time.Now()
+			p.runPoll(ctx)
+		case <-p.wake:
+			lastPoll = time.Now()
+			p.runPoll(ctx)
 		}
 	}
 }
 
+// runPoll polls once, backing off exponentially while the RPC rate limits
+func (p *Poller) runPoll(ctx context.Context) {
+	if time.Now().Before(p.rateLimitedUntil) {
+		return
+	}
+
+	err := p.poll(ctx)
+	if err != nil && isRateLimitError(err) {
+		if p.rateLimitBackoff == 0 {
+			p.rateLimitBackoff = p.pollingInterval
+		} else {
+			p.rateLimitBackoff *= 2
+		}
+		if p.rateLimitBackoff > maxRateLimitBackoff {
+			p.rateLimitBackoff = maxRateLimitBackoff
+		}
+		p.rateLimitedUntil = time.Now().Add(p.rateLimitBackoff)
+		logger.Log.WithField("backoff", p.rateLimitBackoff).WithError(err).Warn("Rate limited by RPC, backing off")
+		return
+	}
+
+	p.rateLimitBackoff = 0
+	if err != nil {
+		logger.Log.WithError(err).Error("Polling failed")
+	}
+}
+
+// PollNow makes the running poller check for new events immediately
+func (p *Poller) PollNow() {
+	notify(p.wake)
+}
+
 // poll checks for new events
 func (p *Poller) poll(ctx context.Context) error {
 	// Get current block
-	currentBlock, err := p.client.BlockNumber(ctx)
+	headBlock, err := p.client.BlockNumber(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get current block: %w", err)
 	}
 
-	// No new blocks
+	if err := p.checkReorg(ctx); err != nil {
+		return err
+	}
+
+	// No new confirmed blocks
+	currentBlock := safeHead(headBlock, p.confirmations)
 	if currentBlock <= p.lastBlock {
 		return nil
 	}
 
+	// Walk the range in chunks, advancing the checkpoint after each one so
+	// progress survives a failure further along
+	for p.lastBlock < currentBlock {
+		from := p.lastBlock + 1
+		to := from + p.chunkSize - 1
+		if to > currentBlock {
+			to = currentBlock
+		}
+
+		logs, err := p.filterLogs(ctx, from, to)
+		if err != nil {
+			// "rate limit exceeded" also reads like a range error
+			if isRangeError(err) && !isRateLimitError(err) && p.chunkSize > 1 {
+				p.chunkSize /= 2
+				logger.Log.WithFields(map[string]interface{}{
+					"from":      from,
+					"to":        to,
+					"chunkSize": p.chunkSize,
+				}).WithError(err).Warn("Block range rejected by RPC, halving chunk size")
+				continue
+			}
+			return err
+		}
+
+		// Refuse to act on logs whose block is no longer canonical; the
+		// chunk is retried on the next poll
+		if err := p.verifyLogBlocks(ctx, logs); err != nil {
+			return err
+		}
+
+		// Process events
+		for _, vLog := range logs {
+			if vLog.Removed {
+				logger.Log.WithFields(map[string]interface{}{
+					"block":  vLog.BlockNumber,
+					"txHash": vLog.TxHash.Hex(),
+				}).Warn("Ignoring event removed by chain reorganization")
+				continue
+			}
+			// Do not advance past events that were never handed off; the
+			// chunk is retried on the next poll and handled commands are
+			// skipped by ID. Malformed events would fail every retry.
+			if err := p.processEvent(ctx, vLog); err != nil {
+				if !errors.Is(err, errMalformedEvent) {
+					return fmt.Errorf("failed to process event in block %d: %w", vLog.BlockNumber, err)
+				}
+				logger.Log.WithError(err).Error("Skipping malformed event")
+			}
+		}
+
+		hash, err := p.client.BlockHash(ctx, to)
+		if err != nil {
+			return err
+		}
+
+		// Update last block
+		p.lastBlock, p.lastBlockHash = to, hash
+		if err := p.storage.SetLastBlock(to, hash.Hex()); err != nil {
+			return fmt.Errorf("failed to save block checkpoint: %w", err)
+		}
+
+		// Recover towards the configured chunk size after a success
+		if p.chunkSize < p.maxChunkSize {
+			p.chunkSize *= 2
+			if p.chunkSize > p.maxChunkSize {
+				p.chunkSize = p.maxChunkSize
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterLogs queries CommandTriggered events in the inclusive block range
+func (p *Poller) filterLogs(ctx context.Context, from, to uint64) ([]ethtypes.Log, error) {
 	logger.Log.WithFields(map[string]interface{}{
-		"from": p.lastBlock + 1,
-		"to":   currentBlock,
+		"from": from,
+		"to":   to,
 	}).Debug("Checking for new events")
 
 	// Query for CommandTriggered events
-	query := ethereum.FilterQuery{
-		FromBlock: big.NewInt(int64(p.lastBlock + 1)),
-		ToBlock:   big.NewInt(int64(currentBlock)),
+	query := p.eventQuery()
+	query.FromBlock = new(big.Int).SetUint64(from)
+	query.ToBlock = new(big.Int).SetUint64(to)
+
+	logs, err := p.client.FilterLogs(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to filter logs: %w", err)
+	}
+
+	return logs, nil
+}
+
+// eventQuery returns a filter for the contract events the poller handles
+func (p *Poller) eventQuery() ethereum.FilterQuery {
+	return ethereum.FilterQuery{
 		Addresses: []common.Address{p.contract},
 		Topics: [][]common.Hash{
-			{p.contractABI.Events["CommandTriggered"].ID},
+			{
+				p.contractABI.Events["CommandTriggered"].ID,
+				p.contractABI.Events["AdminUpdated"].ID,
+			},
 		},
 	}
+}
 
-	logs, err := p.client.FilterLogs(ctx, query)
+// checkReorg compares the checkpoint block hash with the canonical chain and
+// rewinds the checkpoint if the block was reorganized away. Commands are
+// deduplicated by ID, so replaying the rewound range is safe.
+func (p *Poller) checkReorg(ctx context.Context) error {
+	if p.lastBlock == 0 || p.lastBlockHash == (common.Hash{}) {
+		return nil
+	}
+
+	hash, err := p.client.BlockHash(ctx, p.lastBlock)
+	if err != nil {
+		return err
+	}
+	if hash == p.lastBlockHash {
+		return nil
+	}
+
+	rewindTo := reorgFloor(p.lastBlock, p.maxCatchup)
+	if p.lastBlock > p.reorgRewind && p.lastBlock-p.reorgRewind > rewindTo {
+		rewindTo = p.lastBlock - p.reorgRewind
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"block":        p.lastBlock,
+		"expectedHash": p.lastBlockHash.Hex(),
+		"actualHash":   hash.Hex(),
+		"rewindTo":     rewindTo,
+	}).Warn("Chain reorganization detected at checkpoint, rewinding")
+
+	rewindHash, err := p.client.BlockHash(ctx, rewindTo)
 	if err != nil {
-		return fmt.Errorf("failed to filter logs: %w", err)
+		return err
+	}
+
+	p.lastBlock, p.lastBlockHash = rewindTo, rewindHash
+	if err := p.storage.SetLastBlock(rewindTo, rewindHash.Hex()); err != nil {
+		return fmt.Errorf("failed to save block checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// reorgFloor is the lowest block a reorg may rewind to: no more than
+// maxCatchup blocks back, like a restart, and never to block 0, which would
+// read as having no checkpoint and rescan from genesis or skip to the head
+func reorgFloor(lastBlock, maxCatchup uint64) uint64 {
+	if maxCatchup > 0 && lastBlock > maxCatchup {
+		return lastBlock - maxCatchup
 	}
+	return 1
+}
 
-	// Process events
+// verifyLogBlocks checks that every log still belongs to the canonical chain
+func (p *Poller) verifyLogBlocks(ctx context.Context, logs []ethtypes.Log) error {
+	canonical := make(map[uint64]common.Hash)
 	for _, vLog := range logs {
-		if err := p.processEvent(ctx, vLog); err != nil {
-			logger.Log.WithError(err).Error("Failed to process event")
+		if vLog.Removed {
+			continue
 		}
-	}
 
-	// Update last block
-	p.lastBlock = currentBlock
+		hash, ok := canonical[vLog.BlockNumber]
+		if !ok {
+			var err error
+			if hash, err = p.client.BlockHash(ctx, vLog.BlockNumber); err != nil {
+				return err
+			}
+			canonical[vLog.BlockNumber] = hash
+		}
 
+		if hash != vLog.BlockHash {
+			return fmt.Errorf("block %d was reorganized (log hash %s, canonical %s)",
+				vLog.BlockNumber, vLog.BlockHash.Hex(), hash.Hex())
+		}
+	}
 	return nil
 }
 
-// processEvent processes a CommandTriggered event
+// rangeErrorHints are substrings of RPC errors returned when a log query
+// covers too many blocks or matches too many results
+var rangeErrorHints = []string{
+	"block range",
+	"range too large",
+	"range is too large",
+	"too many results",
+	"too many logs",
+	"query returned more than",
+	"limit exceeded",
+	"exceeds the limit",
+	"response size",
+}
+
+// rateLimitHints are substrings of RPC errors returned when the endpoint is
+// throttling requests
+var rateLimitHints = []string{
+	"429",
+	"too many requests",
+	"rate limit",
+}
+
+// isRateLimitError reports whether err means the RPC endpoint is throttling us
+func isRateLimitError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, hint := range rateLimitHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRangeError reports whether err means the log query should be narrowed
+func isRangeError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, hint := range rangeErrorHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// errMalformedEvent marks events that cannot be decoded, so retrying them
+// cannot succeed
+var errMalformedEvent = errors.New("malformed event")
+
+// processEvent dispatches a contract event by its signature
 func (p *Poller) processEvent(ctx context.Context, vLog ethtypes.Log) error {
+	if len(vLog.Topics) == 0 {
+		return fmt.Errorf("%w: no topics in tx %s", errMalformedEvent, vLog.TxHash.Hex())
+	}
+
+	switch vLog.Topics[0] {
+	case p.contractABI.Events["CommandTriggered"].ID:
+		return p.processCommandEvent(ctx, vLog)
+	case p.contractABI.Events["AdminUpdated"].ID:
+		return p.processAdminEvent(ctx, vLog)
+	default:
+		return nil
+	}
+}
+
+// processAdminEvent processes an AdminUpdated event
+func (p *Poller) processAdminEvent(ctx context.Context, vLog ethtypes.Log) error {
+	if len(vLog.Topics) < 3 {
+		return fmt.Errorf("%w: AdminUpdated in tx %s", errMalformedEvent, vLog.TxHash.Hex())
+	}
+
+	// both fields are indexed
+	change := &types.AdminChange{
+		OldAdmin: common.BytesToAddress(vLog.Topics[1].Bytes()).Hex(),
+		NewAdmin: common.BytesToAddress(vLog.Topics[2].Bytes()).Hex(),
+		Block:    vLog.BlockNumber,
+		TxHash:   vLog.TxHash.Hex(),
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"oldAdmin": change.OldAdmin,
+		"newAdmin": change.NewAdmin,
+		"block":    change.Block,
+	}).Warn("Contract admin changed")
+
+	select {
+	case p.adminChanges <- change:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// processCommandEvent processes a CommandTriggered event
+func (p *Poller) processCommandEvent(ctx context.Context, vLog ethtypes.Log) error {
 	event := struct {
 		Timestamp        *big.Int
 		CommandType      uint8
@@ -402,8 +830,11 @@ func (p *Poller) processEvent(ctx context.Context, vLog ethtypes.Log) error {
 	}{}
 
 	// unpack non-indexed fields
+	if len(vLog.Topics) < 2 {
+		return fmt.Errorf("%w: CommandTriggered in tx %s", errMalformedEvent, vLog.TxHash.Hex())
+	}
 	if err := p.contractABI.UnpackIntoInterface(&event, "CommandTriggered", vLog.Data); err != nil {
-		return fmt.Errorf("failed to unpack event: %w", err)
+		return fmt.Errorf("%w: failed to unpack CommandTriggered: %v", errMalformedEvent, err)
 	}
 
 	// indexed field
@@ -421,22 +852,21 @@ func (p *Poller) processEvent(ctx context.Context, vLog ethtypes.Log) error {
 		"block":            vLog.BlockNumber,
 	}).Info("New command detected")
 
-	command, err := p.getCommand(ctx, commandId)
+	command, err := p.GetCommand(ctx, commandId)
 	if err != nil {
 		return err
 	}
 
-	if p.commandHandler != nil {
-		if err := p.commandHandler(command); err != nil {
-			return err
-		}
+	select {
+	case p.commands <- command:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return p.storage.MarkExecuted(commandId)
 }
 
-// getCommand fetches full command details from contract
-func (p *Poller) getCommand(ctx context.Context, commandId *big.Int) (*types.Command, error) {
+// GetCommand fetches full command details from contract
+func (p *Poller) GetCommand(ctx context.Context, commandId *big.Int) (*types.Command, error) {
 	// Call getCommand(commandId)
 	data, err := p.contractABI.Pack("getCommand", commandId)
 	if err != nil {
@@ -467,72 +897,17 @@ func (p *Poller) getCommand(ctx context.Context, commandId *big.Int) (*types.Com
 	}
 
 	return &types.Command{
-		ID:          out.Id,
-		CommandType: types.CommandType(out.CommandType),
-		Data:        out.Data,
-		Timestamp:   out.Timestamp,
-		TriggeredBy: out.TriggeredBy.Hex(),
+		ID:               out.Id,
+		CommandType:      types.CommandType(out.CommandType),
+		Data:             out.Data,
+		Timestamp:        out.Timestamp,
+		TriggeredBy:      out.TriggeredBy.Hex(),
+		BackendCommandID: out.BackendCommandId,
 	}, nil
 }
 
-// CheckLatestUnexecutedCommand checks and executes the latest unexecuted command on startup
-func (p *Poller) CheckLatestUnexecutedCommand(ctx context.Context) error {
-	logger.Log.Info("Checking for latest unexecuted command on startup")
-
-	// Get latest command ID from contract
-	latestID, err := p.getLatestCommandId(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get latest command ID: %w", err)
-	}
-
-	// If no commands exist
-	if latestID.Cmp(big.NewInt(0)) == 0 {
-		logger.Log.Info("No commands found in contract")
-		return nil
-	}
-
-	logger.Log.WithField("latestCommandId", latestID.String()).Info("Latest command ID from contract")
-
-	// Check if already executed
-	if p.storage.IsExecuted(latestID) {
-		logger.Log.WithField("commandId", latestID.String()).Info("Latest command already executed")
-		return nil
-	}
-
-	// If this is the first run, just mark as executed without running
-	if p.storage.IsFirstRun() {
-		logger.Log.WithField("commandId", latestID.String()).Info("First run detected - marking latest command as executed without running")
-		if err := p.storage.MarkExecuted(latestID); err != nil {
-			logger.Log.WithError(err).Error("Failed to mark command as executed")
-		}
-		return nil
-	}
-
-	logger.Log.WithField("commandId", latestID.String()).Info("Found unexecuted command, executing now")
-
-	// Fetch command details
-	command, err := p.getCommand(ctx, latestID)
-	if err != nil {
-		return fmt.Errorf("failed to get command: %w", err)
-	}
-
-	// Execute command
-	if p.commandHandler != nil {
-		if err := p.commandHandler(command); err != nil {
-			return fmt.Errorf("handler failed: %w", err)
-		}
-	}
-
-	// Mark as executed
-	if err := p.storage.MarkExecuted(latestID); err != nil {
-		logger.Log.WithError(err).Error("Failed to mark command as executed")
-	}
-
-	return nil
-}
-
-// getLatestCommandId fetches the latest command ID from contract
-func (p *Poller) getLatestCommandId(ctx context.Context) (*big.Int, error) {
+// LatestCommandID fetches the latest command ID from contract
+func (p *Poller) LatestCommandID(ctx context.Context) (*big.Int, error) {
 	// Call getLatestCommandId()
 	data, err := p.contractABI.Pack("getLatestCommandId")
 	if err != nil {
@@ -557,9 +932,38 @@ func (p *Poller) getLatestCommandId(ctx context.Context) (*big.Int, error) {
 	return latestID, nil
 }
 
-// Close closes the poller
-func (p *Poller) Close() {
-	if p.client != nil {
+// CurrentAdmin fetches the contract's current admin address
+func (p *Poller) CurrentAdmin(ctx context.Context) (string, error) {
+	data, err := p.contractABI.Pack("admin")
+	if err != nil {
+		return "", fmt.Errorf("failed to pack call: %w", err)
+	}
+
+	result, err := p.client.CallContract(ctx, ethereum.CallMsg{
+		To:   &p.contract,
+		Data: data,
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to call contract: %w", err)
+	}
+
+	var admin common.Address
+	if err := p.contractABI.UnpackIntoInterface(&admin, "admin", result); err != nil {
+		return "", fmt.Errorf("failed to unpack result: %w", err)
+	}
+
+	return admin.Hex(), nil
+}
+
+// Stop stops polling and closes the chain client
+func (p *Poller) Stop() {
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.mu.Unlock()
+
+	if p.closeClient {
 		p.client.Close()
 	}
 }
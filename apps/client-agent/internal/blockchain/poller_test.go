@@ -0,0 +1,345 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	if err := logger.InitAudit(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+var testContract = common.HexToAddress("0x5555555555555555555555555555555555555555")
+
+// fakeChain is a chainClient serving a fixed set of logs
+type fakeChain struct {
+	abi abi.ABI
+
+	mu          sync.Mutex
+	head        uint64
+	logs        []ethtypes.Log
+	maxRange    uint64 // wider FilterLogs ranges are rejected, 0 = no limit
+	rateLimited int    // FilterLogs calls still to fail with a rate limit
+	callErrors  int    // CallContract calls still to fail
+	filtered    [][2]uint64
+}
+
+func newFakeChain(t *testing.T, head uint64) *fakeChain {
+	t.Helper()
+	parsed, err := abi.JSON(strings.NewReader(deviceControlABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeChain{abi: parsed, head: head}
+}
+
+// blockHash is the canonical hash of a block on the fake chain
+func blockHash(n uint64) common.Hash {
+	return common.BigToHash(new(big.Int).SetUint64(n + 1000))
+}
+
+// addCommand emits a CommandTriggered event for id in block
+func (c *fakeChain) addCommand(t *testing.T, block uint64, id int64) {
+	t.Helper()
+	event := c.abi.Events["CommandTriggered"]
+	data, err := event.Inputs.NonIndexed().Pack(big.NewInt(time.Now().Unix()), uint8(0), fmt.Sprintf("backend-%d", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs = append(c.logs, ethtypes.Log{
+		Address:     testContract,
+		Topics:      []common.Hash{event.ID, common.BigToHash(big.NewInt(id))},
+		Data:        data,
+		BlockNumber: block,
+		BlockHash:   blockHash(block),
+	})
+}
+
+func (c *fakeChain) setHead(head uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.head = head
+}
+
+func (c *fakeChain) BlockNumber(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head, nil
+}
+
+func (c *fakeChain) BlockHash(ctx context.Context, number uint64) (common.Hash, error) {
+	return blockHash(number), nil
+}
+
+func (c *fakeChain) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]ethtypes.Log, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	if c.rateLimited > 0 {
+		c.rateLimited--
+		return nil, errors.New("429 Too Many Requests: rate limit exceeded")
+	}
+	if c.maxRange > 0 && to-from+1 > c.maxRange {
+		return nil, fmt.Errorf("block range too large, max %d", c.maxRange)
+	}
+
+	c.filtered = append(c.filtered, [2]uint64{from, to})
+	var logs []ethtypes.Log
+	for _, l := range c.logs {
+		if l.BlockNumber >= from && l.BlockNumber <= to {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func (c *fakeChain) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.callErrors > 0 {
+		c.callErrors--
+		return nil, errors.New("connection reset by peer")
+	}
+
+	method := c.abi.Methods["getCommand"]
+	if !bytes.Equal(msg.Data[:4], method.ID) {
+		return nil, fmt.Errorf("unexpected call %x", msg.Data[:4])
+	}
+	args, err := method.Inputs.Unpack(msg.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	id := args[0].(*big.Int)
+	return method.Outputs.Pack(id, uint8(0), "ZWNobyBvawo=", big.NewInt(time.Now().Unix()), testContract, fmt.Sprintf("backend-%s", id))
+}
+
+func (c *fakeChain) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- ethtypes.Log) (ethereum.Subscription, error) {
+	return nil, errors.New("subscriptions not supported")
+}
+
+func (c *fakeChain) SupportsSubscriptions() bool { return false }
+
+func (c *fakeChain) Close() {}
+
+// newTestPoller creates a poller over chain, starting at its current head
+func newTestPoller(t *testing.T, chain *fakeChain, chunkSize uint64) (*Poller, *storage.Storage) {
+	t.Helper()
+	store, err := storage.NewStorage(t.TempDir(), make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	p, err := newPoller(&types.Config{
+		ContractAddress: testContract.Hex(),
+		PollingInterval: 100 * time.Millisecond,
+		LogChunkSize:    chunkSize,
+	}, store, chain, false)
+	if err != nil {
+		t.Fatalf("newPoller: %v", err)
+	}
+	return p, store
+}
+
+// collect receives streamed commands until ctx is cancelled
+func collect(ctx context.Context, p *Poller) <-chan []*big.Int {
+	out := make(chan []*big.Int, 1)
+	go func() {
+		var ids []*big.Int
+		for {
+			select {
+			case cmd := <-p.Commands():
+				ids = append(ids, cmd.ID)
+			case <-ctx.Done():
+				out <- ids
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func TestPollRetriesChunkWhenEventFails(t *testing.T) {
+	chain := newFakeChain(t, 5)
+	p, store := newTestPoller(t, chain, 100)
+
+	chain.addCommand(t, 8, 1)
+	chain.setHead(15)
+	chain.callErrors = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := collect(ctx, p)
+
+	if err := p.poll(ctx); err == nil {
+		t.Fatal("poll succeeded although the command could not be fetched")
+	}
+	if block, _ := store.GetLastBlock(); block > 5 || p.lastBlock != 5 {
+		t.Fatalf("checkpoint advanced to %d (poller %d) past an unhandled event", block, p.lastBlock)
+	}
+
+	if err := p.poll(ctx); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if block, _ := store.GetLastBlock(); block != 15 {
+		t.Fatalf("checkpoint = %d, want 15", block)
+	}
+
+	cancel()
+	ids := <-received
+	if len(ids) != 1 || ids[0].Int64() != 1 {
+		t.Fatalf("received commands %v, want [1]", ids)
+	}
+}
+
+func TestPollSkipsMalformedEvents(t *testing.T) {
+	chain := newFakeChain(t, 5)
+	p, store := newTestPoller(t, chain, 100)
+
+	chain.logs = append(chain.logs, ethtypes.Log{
+		Address:     testContract,
+		Topics:      []common.Hash{chain.abi.Events["CommandTriggered"].ID},
+		BlockNumber: 7,
+		BlockHash:   blockHash(7),
+	})
+	chain.setHead(10)
+
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if block, _ := store.GetLastBlock(); block != 10 {
+		t.Fatalf("checkpoint = %d, want 10", block)
+	}
+}
+
+func TestPollHalvesChunkOnRangeError(t *testing.T) {
+	chain := newFakeChain(t, 5)
+	p, _ := newTestPoller(t, chain, 8)
+
+	chain.maxRange = 2
+	chain.addCommand(t, 12, 1)
+	chain.setHead(21)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := collect(ctx, p)
+	if err := p.poll(ctx); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	cancel()
+
+	if p.lastBlock != 21 {
+		t.Fatalf("lastBlock = %d, want 21", p.lastBlock)
+	}
+	if ids := <-received; len(ids) != 1 {
+		t.Fatalf("received commands %v, want [1]", ids)
+	}
+
+	// Accepted ranges are contiguous and within the endpoint's limit
+	next := uint64(6)
+	for _, r := range chain.filtered {
+		if r[0] != next || r[1]-r[0]+1 > chain.maxRange {
+			t.Fatalf("filtered ranges %v", chain.filtered)
+		}
+		next = r[1] + 1
+	}
+	if p.chunkSize > p.maxChunkSize || p.chunkSize < 1 {
+		t.Fatalf("chunkSize = %d", p.chunkSize)
+	}
+}
+
+func TestRunPollBacksOffOnRateLimit(t *testing.T) {
+	chain := newFakeChain(t, 5)
+	p, _ := newTestPoller(t, chain, 8)
+	chain.setHead(10)
+	chain.rateLimited = 2
+	ctx := context.Background()
+
+	p.runPoll(ctx)
+	if p.rateLimitBackoff != p.pollingInterval {
+		t.Fatalf("backoff = %v, want %v", p.rateLimitBackoff, p.pollingInterval)
+	}
+	if p.chunkSize != 8 {
+		t.Fatalf("rate limit shrank the chunk size to %d", p.chunkSize)
+	}
+
+	// Polls are skipped while backing off
+	p.runPoll(ctx)
+	if chain.rateLimited != 1 {
+		t.Fatalf("polled while backing off")
+	}
+
+	p.rateLimitedUntil = time.Time{}
+	p.runPoll(ctx)
+	if p.rateLimitBackoff != 2*p.pollingInterval {
+		t.Fatalf("backoff = %v, want %v", p.rateLimitBackoff, 2*p.pollingInterval)
+	}
+
+	// A successful poll resets the backoff
+	p.rateLimitedUntil = time.Time{}
+	p.runPoll(ctx)
+	if p.rateLimitBackoff != 0 || p.lastBlock != 10 {
+		t.Fatalf("after recovery backoff = %v, lastBlock = %d", p.rateLimitBackoff, p.lastBlock)
+	}
+}
+
+func TestCheckReorgRewindFloor(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastBlock   uint64
+		reorgRewind uint64
+		maxCatchup  uint64
+		want        uint64
+	}{
+		{name: "rewind", lastBlock: 1000, reorgRewind: 64, maxCatchup: 50000, want: 936},
+		{name: "young chain", lastBlock: 40, reorgRewind: 64, maxCatchup: 50000, want: 1},
+		{name: "young chain without catch-up limit", lastBlock: 40, reorgRewind: 64, want: 1},
+		{name: "capped by catch-up window", lastBlock: 100000, reorgRewind: 90000, maxCatchup: 50000, want: 50000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newFakeChain(t, tt.lastBlock)
+			p, store := newTestPoller(t, chain, 100)
+			p.reorgRewind, p.maxCatchup = tt.reorgRewind, tt.maxCatchup
+
+			// The checkpoint block was replaced by another one
+			p.lastBlock, p.lastBlockHash = tt.lastBlock, common.HexToHash("0xdead")
+			if err := p.checkReorg(context.Background()); err != nil {
+				t.Fatalf("checkReorg: %v", err)
+			}
+
+			if p.lastBlock != tt.want || p.lastBlockHash != blockHash(tt.want) {
+				t.Fatalf("rewound to %d (%s), want %d", p.lastBlock, p.lastBlockHash.Hex(), tt.want)
+			}
+			if block, hash := store.GetLastBlock(); block != tt.want || hash != blockHash(tt.want).Hex() {
+				t.Fatalf("checkpoint = %d %s, want %d", block, hash, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/phd/client-agent/internal/logger"
+)
+
+const (
+	minResubscribeDelay = time.Second
+	maxResubscribeDelay = time.Minute
+)
+
+// isWebSocketURL reports whether the RPC endpoint supports subscriptions
+func isWebSocketURL(rpcURL string) bool {
+	u := strings.ToLower(rpcURL)
+	return strings.HasPrefix(u, "ws://") || strings.HasPrefix(u, "wss://")
+}
+
+// subscriptionActive reports whether a log subscription is currently live
+func (p *Poller) subscriptionActive() bool {
+	return p.subscribed.Load()
+}
+
+// subscribeLoop keeps a CommandTriggered log subscription open, signalling
+// wake whenever a matching log arrives. Dropped subscriptions are re-opened
+// with exponential backoff; if the endpoint does not support subscriptions
+// at all, the loop exits and the poller keeps its regular polling schedule.
+func (p *Poller) subscribeLoop(ctx context.Context, wake chan<- struct{}) {
+	delay := minResubscribeDelay
+
+	for {
+		logs := make(chan ethtypes.Log, 16)
+		sub, err := p.client.SubscribeFilterLogs(ctx, p.eventQuery(), logs)
+		if err != nil {
+			if isSubscriptionUnsupported(err) {
+				logger.Log.WithError(err).Warn("Log subscriptions not supported by RPC, falling back to polling")
+				return
+			}
+
+			logger.Log.WithError(err).WithField("retryIn", delay).Warn("Failed to subscribe to logs")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxResubscribeDelay {
+				delay = maxResubscribeDelay
+			}
+			continue
+		}
+
+		logger.Log.Info("Subscribed to CommandTriggered events")
+		p.subscribed.Store(true)
+		delay = minResubscribeDelay
+
+		// Catch anything emitted while we were (re)subscribing
+		notify(wake)
+
+		err = forwardLogs(ctx, sub.Err(), logs, wake)
+		p.subscribed.Store(false)
+		sub.Unsubscribe()
+
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Log.WithError(err).Warn("Log subscription dropped, resubscribing")
+	}
+}
+
+// forwardLogs signals wake for every received log until the subscription
+// fails or ctx is cancelled
+func forwardLogs(ctx context.Context, errc <-chan error, logs <-chan ethtypes.Log, wake chan<- struct{}) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case vLog := <-logs:
+			logger.Log.WithField("block", vLog.BlockNumber).Debug("Received event from subscription")
+			notify(wake)
+		}
+	}
+}
+
+// notify sends on a buffered wake channel without blocking
+func notify(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// isSubscriptionUnsupported reports whether err means the endpoint can never
+// serve eth_subscribe, as opposed to a transient failure
+func isSubscriptionUnsupported(err error) bool {
+	if errors.Is(err, rpc.ErrNotificationsUnsupported) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "notifications not supported") ||
+		strings.Contains(msg, "method not found") ||
+		strings.Contains(msg, "does not exist") ||
+		strings.Contains(msg, "not supported")
+}
@@ -1,16 +1,33 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"github.com/phd/client-agent/internal/fsutil"
 	"github.com/phd/client-agent/pkg/types"
 	"github.com/spf13/viper"
 )
 
+// defaultRPCURL is used when neither RPC_URL nor RPC_URLS is set
+const defaultRPCURL = "https://testnet.hashio.io/api"
+
+// mirrorNodeURLs are the public Hedera Mirror Node REST endpoints by network
+var mirrorNodeURLs = map[string]string{
+	"mainnet":    "https://mainnet-public.mirrornode.hedera.com",
+	"testnet":    "https://testnet.mirrornode.hedera.com",
+	"previewnet": "https://previewnet.mirrornode.hedera.com",
+}
+
 // Load loads configuration from environment and config file
 func Load() (*types.Config, error) {
 	// Load .env file if exists
@@ -36,15 +53,83 @@ func Load() (*types.Config, error) {
 
 	// Build config
 	cfg := &types.Config{
-		Network:          viper.GetString("BLOCKCHAIN_NETWORK"),
-		ContractAddress:  viper.GetString("CONTRACT_ADDRESS"),
-		RPCURL:           viper.GetString("RPC_URL"),
-		ClientID:         viper.GetString("CLIENT_ID"),
-		PollingInterval:  time.Duration(viper.GetInt("POLLING_INTERVAL")) * time.Millisecond,
-		ExecutionTimeout: time.Duration(viper.GetInt("EXECUTION_TIMEOUT")) * time.Millisecond,
-		MaxRetryAttempts: viper.GetInt("MAX_RETRY_ATTEMPTS"),
-		LogLevel:         viper.GetString("LOG_LEVEL"),
-		LogFile:          viper.GetString("LOG_FILE"),
+		CommandSource:            types.CommandSourceKind(viper.GetString("COMMAND_SOURCE")),
+		MirrorNodeURL:            viper.GetString("MIRROR_NODE_URL"),
+		CommandDir:               viper.GetString("COMMAND_DIR"),
+		Network:                  viper.GetString("BLOCKCHAIN_NETWORK"),
+		ContractAddress:          viper.GetString("CONTRACT_ADDRESS"),
+		RPCURL:                   viper.GetString("RPC_URL"),
+		MaxHeadLag:               viper.GetUint64("MAX_HEAD_LAG"),
+		HeadCheckInterval:        time.Duration(viper.GetInt("HEAD_CHECK_INTERVAL")) * time.Millisecond,
+		SubscriptionPollInterval: time.Duration(viper.GetInt("SUBSCRIPTION_POLL_INTERVAL")) * time.Millisecond,
+		ClientID:                 viper.GetString("CLIENT_ID"),
+		PollingInterval:          time.Duration(viper.GetInt("POLLING_INTERVAL")) * time.Millisecond,
+		ExecutionTimeout:         time.Duration(viper.GetInt("EXECUTION_TIMEOUT")) * time.Millisecond,
+		KillGracePeriod:          time.Duration(viper.GetInt("KILL_GRACE_PERIOD")) * time.Millisecond,
+		MaxRetryAttempts:         viper.GetInt("MAX_RETRY_ATTEMPTS"),
+		MaxCatchupBlocks:         viper.GetUint64("MAX_CATCHUP_BLOCKS"),
+		LogChunkSize:             viper.GetUint64("LOG_CHUNK_SIZE"),
+		Confirmations:            viper.GetUint64("CONFIRMATIONS"),
+		ReorgRewindBlocks:        viper.GetUint64("REORG_REWIND_BLOCKS"),
+		BackfillPolicy:           types.BackfillPolicy(viper.GetString("BACKFILL_POLICY")),
+		BackfillMaxAge:           time.Duration(viper.GetInt("BACKFILL_MAX_AGE")) * time.Hour,
+		HistoryMaxAge:            time.Duration(viper.GetInt("HISTORY_MAX_AGE")) * 24 * time.Hour,
+		HistoryMaxCount:          viper.GetInt("HISTORY_MAX_COUNT"),
+		ReportURL:                viper.GetString("REPORT_URL"),
+		ReportSecret:             viper.GetString("REPORT_SECRET"),
+		ReportOutputLimit:        viper.GetInt("REPORT_OUTPUT_LIMIT"),
+		OutboxMaxSize:            viper.GetInt64("OUTBOX_MAX_SIZE") * 1024 * 1024,
+		AckContractAddress:       viper.GetString("ACK_CONTRACT_ADDRESS"),
+		AckPrivateKey:            viper.GetString("ACK_PRIVATE_KEY"),
+		HeartbeatURL:             viper.GetString("HEARTBEAT_URL"),
+		HeartbeatInterval:        time.Duration(viper.GetInt("HEARTBEAT_INTERVAL")) * time.Millisecond,
+		RunAsUser:                viper.GetString("RUN_AS_USER"),
+		RunAsGroup:               viper.GetString("RUN_AS_GROUP"),
+		TrustStore:               viper.GetString("TRUST_STORE"),
+		SignatureMaxAge:          time.Duration(viper.GetInt("SIGNATURE_MAX_AGE")) * time.Minute,
+		ReconcileInterval:        time.Duration(viper.GetInt("RECONCILE_INTERVAL")) * time.Millisecond,
+		InterruptedPolicy:        types.InterruptedPolicy(viper.GetString("INTERRUPTED_COMMAND_POLICY")),
+		DataDir:                  viper.GetString("DATA_DIR"),
+		StateKeySource:           types.KeySource(viper.GetString("STATE_KEY_SOURCE")),
+		StateKeyFile:             viper.GetString("STATE_KEY_FILE"),
+		LogLevel:                 viper.GetString("LOG_LEVEL"),
+		LogFile:                  viper.GetString("LOG_FILE"),
+		AuditLogFile:             viper.GetString("AUDIT_LOG_FILE"),
+	}
+
+	if cfg.MirrorNodeURL == "" {
+		cfg.MirrorNodeURL = mirrorNodeURLs[cfg.Network]
+	}
+
+	// The public testnet relay is only a default when no endpoint is configured
+	cfg.RPCURLs = splitList(cfg.RPCURL + "," + viper.GetString("RPC_URLS"))
+	if len(cfg.RPCURLs) == 0 {
+		cfg.RPCURLs = []string{defaultRPCURL}
+	}
+	cfg.Tags = splitList(viper.GetString("CLIENT_TAGS"))
+	cfg.TriggerAllowlist = splitList(viper.GetString("TRIGGER_ALLOWLIST"))
+	cfg.AdminAddresses = splitList(viper.GetString("ADMIN_ADDRESSES"))
+	cfg.ScriptLimits = types.Limits{
+		MemoryMax:    viper.GetInt64("SCRIPT_MEMORY_MAX"),
+		CPUMax:       viper.GetInt("SCRIPT_CPU_MAX"),
+		PidsMax:      viper.GetInt64("SCRIPT_PIDS_MAX"),
+		FileSizeMax:  viper.GetInt64("SCRIPT_FILE_SIZE_MAX"),
+		OpenFilesMax: viper.GetInt64("SCRIPT_OPEN_FILES_MAX"),
+	}
+	cfg.ElevatedScripts = splitList(strings.ToLower(viper.GetString("ELEVATED_SCRIPTS")))
+	if cfg.RPCURL == "" {
+		cfg.RPCURL = cfg.RPCURLs[0]
+	}
+	cfg.StateDir = stateDir(cfg)
+	if cfg.ClientID == "" {
+		id, err := loadClientID(cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientID = id
+	}
+	if cfg.StateKeyFile == "" {
+		cfg.StateKeyFile = defaultKeyFile()
 	}
 
 	// Validate
@@ -55,31 +140,208 @@ func Load() (*types.Config, error) {
 	return cfg, nil
 }
 
+// stateDir namespaces the data directory by network and contract, so agents
+// watching different contracts never share state
+func stateDir(cfg *types.Config) string {
+	namespace := strings.ToLower(cfg.ContractAddress)
+	if cfg.CommandSource == types.CommandSourceFile {
+		namespace = "file"
+	}
+	return filepath.Join(cfg.DataDir, cfg.Network, namespace)
+}
+
+// defaultKeyFile returns the state key location of the platform. It is kept
+// out of DATA_DIR so that access to the database alone does not expose the key.
+func defaultKeyFile() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "phd-client-agent-key", "state.key")
+	}
+	return "/etc/phd-client-agent/state.key"
+}
+
+// loadClientID returns the client ID saved in dataDir, generating one on
+// first start, so the agent keeps its identity across restarts
+func loadClientID(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, "client-id")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id == "" {
+			return "", fmt.Errorf("client ID file %s is empty", path)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read client ID: %w", err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create data dir: %w", err)
+	}
+
+	// An agent starting at the same time may save its ID first
+	id := uuid.New().String()
+	err = fsutil.CreateExclusive(path, []byte(id+"\n"))
+	if os.IsExist(err) {
+		return loadClientID(dataDir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create client ID file: %w", err)
+	}
+	return id, nil
+}
+
+// defaultDataDir returns the system-wide state location of the platform
+func defaultDataDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "phd-client-agent")
+	case "darwin":
+		return "/Library/Application Support/phd-client-agent"
+	default:
+		return "/var/lib/phd-client-agent"
+	}
+}
+
+// splitList splits a comma-separated setting, dropping blanks and duplicates
+// while keeping the original order
+func splitList(list string) []string {
+	var items []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || seen[item] {
+			continue
+		}
+		seen[item] = true
+		items = append(items, item)
+	}
+	return items
+}
+
 func setDefaults() {
 	viper.SetDefault("BLOCKCHAIN_NETWORK", "testnet")
+	viper.SetDefault("COMMAND_SOURCE", string(types.CommandSourceRPC))
+	viper.SetDefault("COMMAND_DIR", "commands")
 	viper.SetDefault("CONTRACT_ADDRESS", "0x1e8678A15DAf23C01d0A972D86F5D692469D392c")
-	viper.SetDefault("RPC_URL", "https://testnet.hashio.io/api")
-	viper.SetDefault("POLLING_INTERVAL", 5000)   // milliseconds
-	viper.SetDefault("EXECUTION_TIMEOUT", 30000) // milliseconds
+	viper.SetDefault("MAX_HEAD_LAG", 10)                  // blocks
+	viper.SetDefault("HEAD_CHECK_INTERVAL", 30000)        // milliseconds
+	viper.SetDefault("POLLING_INTERVAL", 5000)            // milliseconds
+	viper.SetDefault("SUBSCRIPTION_POLL_INTERVAL", 60000) // milliseconds, used with ws:// and wss:// RPC URLs
+	viper.SetDefault("EXECUTION_TIMEOUT", 30000)          // milliseconds
+	viper.SetDefault("KILL_GRACE_PERIOD", 5000)           // milliseconds
+	viper.SetDefault("SCRIPT_MEMORY_MAX", 0)              // megabytes, 0 = unlimited
+	viper.SetDefault("SCRIPT_CPU_MAX", 0)                 // percent of one CPU, 0 = unlimited
+	viper.SetDefault("SCRIPT_PIDS_MAX", 0)                // 0 = unlimited
+	viper.SetDefault("SCRIPT_FILE_SIZE_MAX", 0)           // megabytes, 0 = unlimited
+	viper.SetDefault("SCRIPT_OPEN_FILES_MAX", 0)          // 0 = unlimited
 	viper.SetDefault("MAX_RETRY_ATTEMPTS", 3)
+	viper.SetDefault("MAX_CATCHUP_BLOCKS", 50000) // 0 = unlimited
+	viper.SetDefault("LOG_CHUNK_SIZE", 1000)      // blocks per FilterLogs query
+	viper.SetDefault("CONFIRMATIONS", 0)          // Hedera has instant finality
+	viper.SetDefault("REORG_REWIND_BLOCKS", 64)
+	viper.SetDefault("BACKFILL_POLICY", string(types.BackfillAll))
+	viper.SetDefault("BACKFILL_MAX_AGE", 24)      // hours
+	viper.SetDefault("RECONCILE_INTERVAL", 60000) // milliseconds, 0 = startup only
+	viper.SetDefault("SIGNATURE_MAX_AGE", 60)     // minutes
+	viper.SetDefault("INTERRUPTED_COMMAND_POLICY", string(types.InterruptedAbandon))
+	viper.SetDefault("HISTORY_MAX_AGE", 90)
+	viper.SetDefault("HISTORY_MAX_COUNT", 1000)
+	viper.SetDefault("REPORT_OUTPUT_LIMIT", 4096)
+	viper.SetDefault("OUTBOX_MAX_SIZE", 10)
+	viper.SetDefault("HEARTBEAT_INTERVAL", 60000)
+	viper.SetDefault("DATA_DIR", defaultDataDir())
+	viper.SetDefault("STATE_KEY_SOURCE", string(types.KeySourceFile))
 	viper.SetDefault("LOG_LEVEL", "info")
 	viper.SetDefault("LOG_FILE", "client-agent.log")
-
-	// Generate client ID if not set
-	if os.Getenv("CLIENT_ID") == "" {
-		viper.SetDefault("CLIENT_ID", uuid.New().String())
-	}
+	viper.SetDefault("AUDIT_LOG_FILE", "audit.log")
 }
 
 func validate(cfg *types.Config) error {
 	if cfg.ContractAddress == "" {
 		return fmt.Errorf("CONTRACT_ADDRESS is required")
 	}
-	if cfg.RPCURL == "" {
-		return fmt.Errorf("RPC_URL is required")
+	for _, addr := range append(append([]string{}, cfg.TriggerAllowlist...), cfg.AdminAddresses...) {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("invalid address %q in TRIGGER_ALLOWLIST or ADMIN_ADDRESSES", addr)
+		}
+	}
+	if cfg.RunAsUser != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("RUN_AS_USER is not supported on windows")
+	}
+	if cfg.RunAsGroup != "" && (cfg.RunAsUser == "" || cfg.RunAsUser == string(types.RunAsDesktop)) {
+		return fmt.Errorf("RUN_AS_GROUP requires a named RUN_AS_USER")
+	}
+	for _, digest := range cfg.ElevatedScripts {
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 digest %q in ELEVATED_SCRIPTS", digest)
+		}
+	}
+	if l := cfg.ScriptLimits; l.MemoryMax < 0 || l.CPUMax < 0 || l.PidsMax < 0 || l.FileSizeMax < 0 || l.OpenFilesMax < 0 {
+		return fmt.Errorf("SCRIPT_*_MAX limits must not be negative")
+	}
+	if cfg.KillGracePeriod < 0 {
+		return fmt.Errorf("KILL_GRACE_PERIOD must not be negative")
+	}
+	if cfg.HeartbeatURL != "" && cfg.HeartbeatInterval <= 0 {
+		return fmt.Errorf("HEARTBEAT_INTERVAL must be positive")
+	}
+	if cfg.AckContractAddress != "" {
+		if !common.IsHexAddress(cfg.AckContractAddress) {
+			return fmt.Errorf("invalid ACK_CONTRACT_ADDRESS %q", cfg.AckContractAddress)
+		}
+		if cfg.AckPrivateKey == "" {
+			return fmt.Errorf("ACK_PRIVATE_KEY is required with ACK_CONTRACT_ADDRESS")
+		}
+	}
+	switch cfg.CommandSource {
+	case types.CommandSourceRPC:
+		if len(cfg.RPCURLs) == 0 {
+			return fmt.Errorf("RPC_URL or RPC_URLS is required")
+		}
+	case types.CommandSourceMirror:
+		if cfg.MirrorNodeURL == "" {
+			return fmt.Errorf("MIRROR_NODE_URL is required for network %q", cfg.Network)
+		}
+	case types.CommandSourceFile:
+		if cfg.CommandDir == "" {
+			return fmt.Errorf("COMMAND_DIR is required when COMMAND_SOURCE is %s", types.CommandSourceFile)
+		}
+	default:
+		return fmt.Errorf("invalid COMMAND_SOURCE %q (expected rpc, mirror or file)", cfg.CommandSource)
 	}
 	if cfg.ClientID == "" {
 		return fmt.Errorf("CLIENT_ID is required")
 	}
+	if cfg.LogChunkSize == 0 {
+		return fmt.Errorf("LOG_CHUNK_SIZE must be at least 1")
+	}
+	switch cfg.BackfillPolicy {
+	case types.BackfillAll, types.BackfillLatest:
+	case types.BackfillMaxAge:
+		if cfg.BackfillMaxAge <= 0 {
+			return fmt.Errorf("BACKFILL_MAX_AGE must be positive when BACKFILL_POLICY is %s", types.BackfillMaxAge)
+		}
+	default:
+		return fmt.Errorf("invalid BACKFILL_POLICY %q (expected all, latest or max-age)", cfg.BackfillPolicy)
+	}
+	switch cfg.StateKeySource {
+	case types.KeySourceFile, types.KeySourceKeyring, types.KeySourceSecretService:
+	default:
+		return fmt.Errorf("invalid STATE_KEY_SOURCE %q (expected file, keyring or secret-service)", cfg.StateKeySource)
+	}
+	switch cfg.InterruptedPolicy {
+	case types.InterruptedAbandon, types.InterruptedRerun:
+	default:
+		return fmt.Errorf("invalid INTERRUPTED_COMMAND_POLICY %q (expected abandon or rerun)", cfg.InterruptedPolicy)
+	}
 	return nil
 }
@@ -0,0 +1,253 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phd/client-agent/internal/fsutil"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// SocketDirName is the directory holding the control socket inside the state
+// directory. The socket is created in it rather than next to the state, so it
+// is never reachable with looser permissions than the directory's 0700.
+const SocketDirName = "control"
+
+// SocketFileName is the control socket inside SocketDirName
+const SocketFileName = "control.sock"
+
+// Control commands
+const (
+	CommandStatus   = "status"
+	CommandPause    = "pause"
+	CommandResume   = "resume"
+	CommandPoll     = "poll"
+	CommandShutdown = "shutdown"
+	CommandHistory  = "history"
+)
+
+// connTimeout bounds a single request on the socket
+const connTimeout = 10 * time.Second
+
+// Request is one command sent over the control socket
+type Request struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason,omitempty"`
+
+	// History selects results by CommandID, or by Query when it is empty
+	CommandID string               `json:"commandId,omitempty"`
+	Query     *storage.ResultQuery `json:"query,omitempty"`
+}
+
+// Response answers a Request
+type Response struct {
+	OK      bool                    `json:"ok"`
+	Error   string                  `json:"error,omitempty"`
+	Status  *types.AgentStatus      `json:"status,omitempty"`
+	Results []*storage.ResultRecord `json:"results,omitempty"`
+}
+
+// Controller is the agent as operated through the control socket
+type Controller interface {
+	Status() *types.AgentStatus
+	Pause(reason string) error
+	Resume() error
+	Poll()
+	History(q storage.ResultQuery) ([]*storage.ResultRecord, error)
+	Result(commandID string) (*storage.ResultRecord, error)
+}
+
+// Server serves the control socket. Access is limited by file permissions:
+// the socket is only accessible to the user running the agent.
+type Server struct {
+	dir      string
+	path     string
+	ctl      Controller
+	version  string
+	shutdown func()
+	listener net.Listener
+}
+
+// NewServer creates a control server for the socket in dir. shutdown is
+// called when a client requests the agent to stop.
+func NewServer(dir string, ctl Controller, version string, shutdown func()) *Server {
+	return &Server{
+		dir:      filepath.Join(dir, SocketDirName),
+		path:     socketPath(dir),
+		ctl:      ctl,
+		version:  version,
+		shutdown: shutdown,
+	}
+}
+
+// Start listens on the socket and serves requests until ctx is cancelled.
+// The caller must hold the state directory lock, since a stale socket left
+// by a crashed agent is removed.
+func (s *Server) Start(ctx context.Context) error {
+	// MkdirAll keeps the mode of a directory that already exists
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create control socket dir: %w", err)
+	}
+	if err := os.Chmod(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to restrict control socket dir: %w", err)
+	}
+	if err := fsutil.CheckPrivateDir(s.dir); err != nil {
+		return fmt.Errorf("failed to restrict control socket dir: %w", err)
+	}
+
+	_ = os.Remove(s.path)
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	s.listener = listener
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+					logger.Log.WithError(err).Error("Control socket stopped")
+				}
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	logger.Log.WithField("socket", s.path).Info("Control socket listening")
+	return nil
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() {
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close()
+	os.Remove(s.path)
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(connTimeout))
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		_ = json.NewEncoder(conn).Encode(&Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	resp := s.handle(&req)
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Log.WithError(err).Debug("Failed to answer control request")
+	}
+}
+
+func (s *Server) handle(req *Request) *Response {
+	if req.Command != CommandStatus && req.Command != CommandHistory {
+		logger.Audit("control_"+req.Command, map[string]interface{}{
+			"reason": req.Reason,
+		})
+	}
+
+	switch req.Command {
+	case CommandStatus:
+		status := s.ctl.Status()
+		status.Version = s.version
+		status.PID = os.Getpid()
+		return &Response{OK: true, Status: status}
+	case CommandPause:
+		reason := req.Reason
+		if reason == "" {
+			reason = "paused by operator"
+		}
+		if err := s.ctl.Pause(reason); err != nil {
+			return &Response{Error: err.Error()}
+		}
+		return &Response{OK: true}
+	case CommandResume:
+		if err := s.ctl.Resume(); err != nil {
+			return &Response{Error: err.Error()}
+		}
+		return &Response{OK: true}
+	case CommandPoll:
+		s.ctl.Poll()
+		return &Response{OK: true}
+	case CommandShutdown:
+		s.shutdown()
+		return &Response{OK: true}
+	case CommandHistory:
+		return s.history(req)
+	default:
+		return &Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+}
+
+// history answers a history request for one command or for a query
+func (s *Server) history(req *Request) *Response {
+	var results []*storage.ResultRecord
+	if req.CommandID != "" {
+		record, err := s.ctl.Result(req.CommandID)
+		if err != nil {
+			return &Response{Error: err.Error()}
+		}
+		if record != nil {
+			results = append(results, record)
+		}
+		return &Response{OK: true, Results: results}
+	}
+
+	var q storage.ResultQuery
+	if req.Query != nil {
+		q = *req.Query
+	}
+	records, err := s.ctl.History(q)
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+	return &Response{OK: true, Results: records}
+}
+
+// socketPath returns the control socket of the state directory dir
+func socketPath(dir string) string {
+	return filepath.Join(dir, SocketDirName, SocketFileName)
+}
+
+// Call sends a request to the control socket in dir
+func Call(dir string, req *Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath(dir), connTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to agent: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(connTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,87 @@
+package control
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	if err := logger.InitAudit(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeController answers status requests
+type fakeController struct{}
+
+func (fakeController) Status() *types.AgentStatus { return &types.AgentStatus{} }
+func (fakeController) Pause(reason string) error  { return nil }
+func (fakeController) Resume() error              { return nil }
+func (fakeController) Poll()                      {}
+func (fakeController) History(q storage.ResultQuery) ([]*storage.ResultRecord, error) {
+	return nil, nil
+}
+func (fakeController) Result(commandID string) (*storage.ResultRecord, error) { return nil, nil }
+
+func TestSocketIsCreatedInPrivateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket access is governed by ACLs on windows")
+	}
+	dir := t.TempDir()
+
+	// A socket dir left with looser permissions is tightened before use
+	if err := os.Mkdir(filepath.Join(dir, SocketDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer(dir, fakeController{}, "test", func() {})
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Close()
+
+	info, err := os.Stat(filepath.Join(dir, SocketDirName))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("socket dir mode = %o, want 700", perm)
+	}
+
+	resp, err := Call(dir, &Request{Command: CommandStatus})
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if !resp.OK || resp.Status == nil {
+		t.Fatalf("status response = %+v", resp)
+	}
+}
+
+func TestStartRefusesSymlinkedSocketDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket access is governed by ACLs on windows")
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, SocketDirName)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(dir, fakeController{}, "test", func() {})
+	if err := s.Start(context.Background()); err == nil {
+		s.Close()
+		t.Fatal("Start accepted a symlinked socket dir")
+	}
+}
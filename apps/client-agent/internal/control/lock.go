@@ -0,0 +1,62 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is the single-instance lock inside the state directory
+const lockFileName = "agent.lock"
+
+// Lock is an exclusive lock on a state directory, held for the lifetime of
+// the process. The operating system releases it if the process dies.
+type Lock struct {
+	file *os.File
+}
+
+// AcquireLock locks dir for this process and records its PID in the lock
+// file. It fails immediately if another agent holds the lock.
+func AcquireLock(dir string) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock dir: %w", err)
+	}
+
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if pid := readPID(path); pid > 0 {
+			return nil, fmt.Errorf("another agent (pid %d) is already running with state in %s", pid, dir)
+		}
+		return nil, fmt.Errorf("another agent is already running with state in %s: %w", dir, err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &Lock{file: f}, nil
+}
+
+// Release unlocks the state directory. The lock file is left in place;
+// removing it would let a second process lock a different inode.
+func (l *Lock) Release() {
+	unlockFile(l.file)
+	l.file.Close()
+}
+
+func readPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
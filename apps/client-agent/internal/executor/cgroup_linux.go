@@ -0,0 +1,265 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/phd/client-agent/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// agentLeaf holds the agent's own processes: a cgroup that enables
+	// controllers for its children cannot hold processes itself
+	agentLeaf = "agent"
+	// cpuPeriod is the cpu.max period in microseconds
+	cpuPeriod = 100000
+)
+
+// cgroups creates the per-script cgroups under base
+type cgroups struct {
+	base string
+}
+
+// cgroup is the transient cgroup of one script run
+type cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newCgroups prepares the agent's own cgroup to hold one child cgroup per
+// script with the memory, cpu and pids controllers, and checks that
+// processes can be started directly inside a child cgroup. Script cgroups
+// stay inside the agent's, so stopping its service also stops them.
+func newCgroups() (*cgroups, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	base, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDelegated(base); err != nil {
+		return nil, err
+	}
+
+	if base == cgroupRoot {
+		// Outside any service manager: the root cgroup may hold processes
+		// and enable controllers, but scripts get a directory of their own
+		base = filepath.Join(cgroupRoot, "phd-client-agent")
+		if err := os.MkdirAll(base, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cgroup: %w", err)
+		}
+		if err := writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+memory +cpu +pids"); err != nil {
+			return nil, fmt.Errorf("failed to enable cgroup controllers: %w", err)
+		}
+	} else if err := moveProcs(base, filepath.Join(base, agentLeaf)); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(base, "cgroup.subtree_control", "+memory +cpu +pids"); err != nil {
+		return nil, fmt.Errorf("failed to enable cgroup controllers: %w", err)
+	}
+
+	c := &cgroups{base: base}
+	c.cleanup()
+
+	// Starting into a cgroup needs clone3, from Linux 5.7
+	probe, err := c.create(types.Limits{})
+	if err != nil {
+		return nil, err
+	}
+	defer probe.remove()
+	cmd := exec.Command("/bin/true")
+	probe.apply(cmd)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to start a process in a cgroup: %w", err)
+	}
+	return c, nil
+}
+
+// ownCgroup returns the directory of the agent's cgroup from /proc/self/cgroup
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("failed to read own cgroup: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The cgroup v2 entry has hierarchy ID 0 and no controllers
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", fmt.Errorf("agent is not in a cgroup v2 hierarchy")
+}
+
+// checkDelegated refuses a systemd unit's cgroup unless the unit delegates
+// it with Delegate=yes; otherwise systemd expects to be its only writer
+func checkDelegated(dir string) error {
+	if !strings.HasSuffix(dir, ".service") && !strings.HasSuffix(dir, ".scope") {
+		return nil
+	}
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		if _, err := unix.Getxattr(dir, attr, nil); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cgroup %s is not delegated, set Delegate=yes in the service unit", strings.TrimPrefix(dir, cgroupRoot))
+}
+
+// moveProcs moves every process in the from cgroup to the to cgroup,
+// creating it. Processes forked meanwhile are caught by the next pass.
+func moveProcs(from, to string) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	for pass := 0; pass < 5; pass++ {
+		data, err := os.ReadFile(filepath.Join(from, "cgroup.procs"))
+		if err != nil {
+			return fmt.Errorf("failed to read cgroup.procs: %w", err)
+		}
+		pids := strings.Fields(string(data))
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			// Processes that exited meanwhile cannot be moved
+			_ = writeCgroupFile(to, "cgroup.procs", pid)
+		}
+	}
+	return fmt.Errorf("failed to move the agent's processes out of %s", from)
+}
+
+// create makes a cgroup with the given limits
+func (c *cgroups) create(limits types.Limits) (*cgroup, error) {
+	c.cleanup()
+	dir, err := os.MkdirTemp(c.base, "script-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	cg := &cgroup{dir: dir}
+
+	if limits.MemoryMax > 0 {
+		if err := writeCgroupFile(dir, "memory.max", strconv.FormatInt(limits.MemoryMax<<20, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+		// Without swap the limit ends in an OOM kill rather than thrashing
+		_ = writeCgroupFile(dir, "memory.swap.max", "0")
+	}
+	if limits.CPUMax > 0 {
+		quota := int64(limits.CPUMax) * cpuPeriod / 100
+		if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.PidsMax > 0 {
+		if err := writeCgroupFile(dir, "pids.max", strconv.FormatInt(limits.PidsMax, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	if cg.fd, err = os.Open(dir); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return cg, nil
+}
+
+// cleanup removes cgroups left empty by earlier runs. Cgroups still holding
+// processes a script left in the background cannot be removed yet.
+func (c *cgroups) cleanup() {
+	entries, err := os.ReadDir(c.base)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "script-") {
+			_ = os.Remove(filepath.Join(c.base, entry.Name()))
+		}
+	}
+}
+
+// apply starts cmd inside the cgroup
+func (cg *cgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+}
+
+// hits reports the limits the cgroup's processes ran into
+func (cg *cgroup) hits() []types.LimitHit {
+	var hits []types.LimitHit
+	if readCgroupStat(cg.dir, "memory.events", "oom_kill") > 0 {
+		hits = append(hits, types.LimitHitMemory)
+	}
+	if readCgroupStat(cg.dir, "cpu.stat", "nr_throttled") > 0 {
+		hits = append(hits, types.LimitHitCPU)
+	}
+	if readCgroupStat(cg.dir, "pids.events", "max") > 0 {
+		hits = append(hits, types.LimitHitPids)
+	}
+	return hits
+}
+
+// kill kills every process in the cgroup, including any that left the
+// script's process group
+func (cg *cgroup) kill() {
+	if writeCgroupFile(cg.dir, "cgroup.kill", "1") == nil {
+		return
+	}
+	// cgroup.kill needs Linux 5.14
+	data, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// remove deletes the cgroup once it is empty
+func (cg *cgroup) remove() {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	_ = os.Remove(cg.dir)
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// readCgroupStat returns a counter from a flat-keyed cgroup file, or 0
+func readCgroupStat(dir, name, key string) int64 {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
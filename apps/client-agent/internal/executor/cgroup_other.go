@@ -0,0 +1,32 @@
+//go:build !linux
+
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// cgroups is only implemented on Linux
+type cgroups struct{}
+
+type cgroup struct{}
+
+func newCgroups() (*cgroups, error) {
+	return nil, fmt.Errorf("cgroups are not supported on %s", runtime.GOOS)
+}
+
+func (c *cgroups) create(limits types.Limits) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroups are not supported on %s", runtime.GOOS)
+}
+
+func (cg *cgroup) apply(cmd *exec.Cmd) {}
+
+func (cg *cgroup) hits() []types.LimitHit { return nil }
+
+func (cg *cgroup) kill() {}
+
+func (cg *cgroup) remove() {}
@@ -3,49 +3,123 @@ package executor
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/phd/client-agent/internal/fsutil"
 	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/signing"
 	"github.com/phd/client-agent/pkg/types"
 )
 
 // Executor executes commands
 type Executor struct {
 	timeout    time.Duration
+	killGrace  time.Duration
 	maxRetries int
 	tempDir    string
+	verifier   *signing.Verifier
+	states     StateRecorder
+
+	runAsUser  string
+	runAsGroup string
+	elevated   map[string]bool
+
+	limits      types.Limits
+	cgroups     *cgroups
+	cgroupsOnce sync.Once
+}
+
+// StateRecorder persists the lifecycle state a command is about to enter
+type StateRecorder interface {
+	SetState(commandID *big.Int, state types.CommandState) error
 }
 
 // NewExecutor creates a new executor
 func NewExecutor(timeout time.Duration, maxRetries int) (*Executor, error) {
-	// Create temp directory for scripts
-	tempDir := filepath.Join(os.TempDir(), "phd-client-agent")
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
+	// Scripts are written to a directory only this executor can change, so
+	// the file that runs is the one whose digest was checked
+	tempDir, err := os.MkdirTemp("", "phd-client-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	if err := fsutil.CheckPrivateDir(tempDir); err != nil {
+		os.RemoveAll(tempDir)
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
 
+	logger.Log.WithField("interpreters", AvailableInterpreters()).Info("Script interpreters available")
+
 	return &Executor{
 		timeout:    timeout,
+		killGrace:  defaultKillGrace,
 		maxRetries: maxRetries,
 		tempDir:    tempDir,
 	}, nil
 }
 
-// Execute executes a command
-func (e *Executor) Execute(cmd *types.Command) *types.ExecutionResult {
+// SetKillGrace sets how long a timed-out script's processes get to exit
+// after SIGTERM before they are killed
+func (e *Executor) SetKillGrace(grace time.Duration) {
+	e.killGrace = grace
+}
+
+// ShutdownTimeout is how long a cancelled script may take to be killed and
+// reaped, so callers can wait for it before removing its files
+func (e *Executor) ShutdownTimeout() time.Duration {
+	return e.killGrace + waitDelay(e.killGrace)
+}
+
+// waitDelay is how long Wait lets output pipes drain after cancellation
+// before it stops waiting on processes that ignore the kill signals
+func waitDelay(grace time.Duration) time.Duration {
+	return grace + time.Second
+}
+
+// SetVerifier requires every command to carry a payload signed by a key in
+// the verifier's trust store
+func (e *Executor) SetVerifier(v *signing.Verifier) {
+	e.verifier = v
+}
+
+// SetStateRecorder persists each state transition before it happens, so a
+// crash never leaves a script running without a record of it
+func (e *Executor) SetStateRecorder(r StateRecorder) {
+	e.states = r
+}
+
+// enter records a state transition. Without a recorder it always succeeds.
+func (e *Executor) enter(cmd *types.Command, state types.CommandState) error {
+	if e.states == nil {
+		return nil
+	}
+	if err := e.states.SetState(cmd.ID, state); err != nil {
+		return fmt.Errorf("failed to enter state %s: %w", state, err)
+	}
+	return nil
+}
+
+// Execute executes a command. If ctx is cancelled while the script runs, its
+// processes are killed and the result is marked abandoned.
+func (e *Executor) Execute(ctx context.Context, cmd *types.Command) *types.ExecutionResult {
 	startTime := time.Now()
 	result := &types.ExecutionResult{
-		CommandID:  cmd.ID,
-		ExecutedAt: startTime,
+		CommandID:        cmd.ID,
+		BackendCommandID: cmd.BackendCommandID,
+		CommandType:      cmd.CommandType,
+		ExecutedAt:       startTime,
+		ExitCode:         -1,
 	}
 
 	logger.Log.WithFields(map[string]interface{}{
@@ -53,6 +127,18 @@ func (e *Executor) Execute(cmd *types.Command) *types.ExecutionResult {
 		"commandType": cmd.CommandType,
 	}).Info("Executing command")
 
+	// Refuse anything not signed by a trusted key
+	if e.verifier != nil {
+		if err := e.verifier.Verify(cmd); err != nil {
+			result.Success = false
+			result.State = types.CommandStateFailed
+			result.Error = fmt.Sprintf("Signature verification failed: %v", err)
+			result.Duration = time.Since(startTime)
+			logger.Log.WithError(err).WithField("commandId", cmd.ID.String()).Error("Refusing unsigned or untrusted command")
+			return result
+		}
+	}
+
 	var scriptContent string
 	var err error
 
@@ -63,33 +149,71 @@ func (e *Executor) Execute(cmd *types.Command) *types.ExecutionResult {
 		scriptContent = cmd.Data
 	case types.CommandTypeURL:
 		// Fetch from URL
-		scriptContent, err = e.fetchFromURL(cmd.Data)
+		if err := e.enter(cmd, types.CommandStateFetching); err != nil {
+			return e.abort(result, err, startTime)
+		}
+		scriptContent, err = e.fetchFromURL(ctx, cmd.Data, cmd.ContentDigest())
+		if ctx.Err() != nil {
+			return e.cancelled(result, startTime)
+		}
 		if err != nil {
 			result.Success = false
+			result.State = types.CommandStateFailed
 			result.Error = fmt.Sprintf("Failed to fetch script from URL: %v", err)
 			result.Duration = time.Since(startTime)
 			return result
 		}
 	default:
 		result.Success = false
+		result.State = types.CommandStateFailed
 		result.Error = fmt.Sprintf("Unknown command type: %d", cmd.CommandType)
 		result.Duration = time.Since(startTime)
 		return result
 	}
 
+	// URL commands are named by their URL unless the payload names them
+	result.ScriptName = cmd.Name()
+	if result.ScriptName == "" && cmd.CommandType == types.CommandTypeURL {
+		result.ScriptName = cmd.Data
+	}
+
+	// A script that cannot be decoded or has no interpreter fails on every attempt
+	content, err := decodeScript(scriptContent)
+	if err != nil {
+		return e.abort(result, err, startTime)
+	}
+	result.ScriptDigest = scriptDigest(content)
+	prepared, err := e.prepareScript(cmd, content)
+	if err != nil {
+		return e.abort(result, err, startTime)
+	}
+
+	// Nothing runs unless the running state is on disk
+	if err := e.enter(cmd, types.CommandStateRunning); err != nil {
+		return e.abort(result, err, startTime)
+	}
+
 	// Execute with retry
 	for attempt := 1; attempt <= e.maxRetries; attempt++ {
-		output, execErr := e.executeScript(scriptContent)
+		output, exitCode, hits, execErr := e.executeScript(ctx, prepared)
+		result.Output = output
+		result.ExitCode = exitCode
+		result.Attempts = attempt
+		result.LimitsHit = hits
 
 		if execErr == nil {
 			// Success
 			result.Success = true
-			result.Output = output
+			result.State = types.CommandStateSucceeded
 			result.Duration = time.Since(startTime)
 			logger.Log.WithField("commandId", cmd.ID.String()).Info("Command executed successfully")
 			return result
 		}
 
+		if ctx.Err() != nil {
+			return e.cancelled(result, startTime)
+		}
+
 		logger.Log.WithFields(map[string]interface{}{
 			"commandId": cmd.ID.String(),
 			"attempt":   attempt,
@@ -97,7 +221,11 @@ func (e *Executor) Execute(cmd *types.Command) *types.ExecutionResult {
 		}).Warn("Execution failed, retrying...")
 
 		if attempt < e.maxRetries {
-			time.Sleep(time.Second * time.Duration(attempt))
+			select {
+			case <-time.After(time.Second * time.Duration(attempt)):
+			case <-ctx.Done():
+				return e.cancelled(result, startTime)
+			}
 		}
 
 		err = execErr
@@ -105,63 +233,122 @@ func (e *Executor) Execute(cmd *types.Command) *types.ExecutionResult {
 
 	// All retries failed
 	result.Success = false
+	result.State = types.CommandStateFailed
 	result.Error = err.Error()
 	result.Duration = time.Since(startTime)
 	logger.Log.WithField("commandId", cmd.ID.String()).Error("Command execution failed after all retries")
 
 	return result
 }
-func (e *Executor) executeScript(base64Script string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
-	defer cancel()
+
+// script is a decoded script with the interpreter and account that run it
+type script struct {
+	content     string
+	interpreter *Interpreter
+	path        string
+	args        []string
+	identity    *identity
+	limits      types.Limits
+}
+
+// decodeScript decodes a command's base64-encoded script
+func decodeScript(base64Script string) (string, error) {
 	base64Script = strings.TrimSpace(base64Script)
 	base64Script = strings.Trim(base64Script, `"`)
 	// 🔐 Decode Base64 → raw script
 	raw, err := base64.StdEncoding.DecodeString(base64Script)
-	fmt.Printf("Executing command %s\n", base64Script)
-
 	if err != nil {
 		return "", fmt.Errorf("invalid base64 script: %w", err)
 	}
-	scriptContent := string(raw)
 
-	var cmd *exec.Cmd
-	var scriptFile string
+	// Unescape common escape sequences from blockchain data
+	content := strings.ReplaceAll(string(raw), "\\n", "\n")
+	content = strings.ReplaceAll(content, "\\t", "\t")
+	content = strings.ReplaceAll(content, "\\r", "\r")
+	return content, nil
+}
 
-	switch runtime.GOOS {
-	case "windows":
-		scriptFile, err = e.createTempScript(scriptContent, ".ps1")
-		if err != nil {
-			return "", err
-		}
-		defer os.Remove(scriptFile)
-
-		cmd = exec.CommandContext(
-			ctx,
-			"powershell",
-			"-NoProfile",
-			"-ExecutionPolicy", "Bypass",
-			"-File", scriptFile,
-		)
-
-	case "darwin", "linux":
-		// Ensure shebang
-		if !strings.HasPrefix(scriptContent, "#!") {
-			scriptContent = "#!/bin/bash\n" + scriptContent
+// prepareScript resolves a decoded script's interpreter and account
+func (e *Executor) prepareScript(cmd *types.Command, content string) (*script, error) {
+	interp, args, err := resolveInterpreter(cmd.Interpreter(), content)
+	if err != nil {
+		return nil, err
+	}
+	path, err := interp.Path()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := e.identityFor(cmd, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &script{
+		content:     content,
+		interpreter: interp,
+		path:        path,
+		args:        args,
+		identity:    id,
+		limits:      e.limitsFor(cmd),
+	}, nil
+}
+
+// executeScript runs a script and returns its output, its exit code or -1 if
+// it did not run to completion, and the resource limits it hit
+func (e *Executor) executeScript(parent context.Context, s *script) (string, int, []types.LimitHit, error) {
+	ctx, cancel := context.WithTimeout(parent, e.timeout)
+	defer cancel()
+
+	file, err := e.createTempScript(s.content, s.interpreter.Ext)
+	if err != nil {
+		return "", -1, nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	cmd := exec.CommandContext(ctx, s.path, s.interpreter.scriptArgs(s.args)...)
+	cmd.Env = scriptEnv(s.identity)
+
+	// The cgroup covers what rlimits cannot; without one, memory is an rlimit
+	var cg *cgroup
+	if needsCgroup(s.limits) {
+		if cgs := e.scriptCgroups(); cgs != nil {
+			if cg, err = cgs.create(s.limits); err != nil {
+				return "", -1, nil, err
+			}
+			defer cg.remove()
+		} else if s.limits.CPUMax > 0 || s.limits.PidsMax > 0 {
+			logger.Log.Warn("CPU and process limits need cgroup v2 and are not enforced")
 		}
+	}
+	if err := wrapRlimits(cmd, s.limits, cg == nil); err != nil {
+		return "", -1, nil, err
+	}
 
-		scriptFile, err = e.createTempScript(scriptContent, ".sh")
+	// The script is the last argument, after any wrapper's own
+	user := "agent"
+	scriptPath := scriptArg(cmd, file)
+	if s.identity != nil {
+		path, cleanup, err := s.identity.apply(cmd, file)
 		if err != nil {
-			return "", err
+			return "", -1, nil, err
 		}
-		defer os.Remove(scriptFile)
-
-		_ = os.Chmod(scriptFile, 0755)
-		cmd = exec.CommandContext(ctx, "/bin/bash", scriptFile)
-
-	default:
-		return "", fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+		defer cleanup()
+		scriptPath = path
+		user = s.identity.username
 	}
+	cmd.Args = append(cmd.Args, scriptPath)
+	stopKill := killTree(cmd, e.killGrace)
+	if cg != nil {
+		cg.apply(cmd)
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"interpreter": s.interpreter.Name,
+		"path":        s.path,
+		"user":        user,
+	}).Debug("Running script")
 
 	// Capture output
 	var stdout, stderr bytes.Buffer
@@ -169,48 +356,94 @@ func (e *Executor) executeScript(base64Script string) (string, error) {
 	cmd.Stderr = &stderr
 
 	err = cmd.Run()
+	stopKill()
 
 	output := stdout.String()
 	if stderr.Len() > 0 {
 		output += "\nSTDERR:\n" + stderr.String()
 	}
 
+	exitCode := -1
+	var hits []types.LimitHit
+	if cg != nil {
+		// Catch processes that escaped the process group
+		if ctx.Err() != nil {
+			cg.kill()
+		}
+		hits = cg.hits()
+	}
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+		if fileSizeHit(cmd.ProcessState) {
+			hits = append(hits, types.LimitHitFileSize)
+		}
+	}
+
 	if err != nil {
+		if parent.Err() != nil {
+			return output, exitCode, hits, fmt.Errorf("execution cancelled: %w", parent.Err())
+		}
+		if errors.Is(err, exec.ErrWaitDelay) && exitCode == 0 {
+			// The script succeeded but left a process holding its output open
+			logger.Log.WithField("interpreter", s.interpreter.Name).Warn("Script exited leaving background processes attached to its output")
+			return output, exitCode, hits, nil
+		}
 		if ctx.Err() == context.DeadlineExceeded {
-			return output, fmt.Errorf("execution timeout after %v", e.timeout)
+			return output, exitCode, hits, fmt.Errorf("execution timeout after %v%s", e.timeout, limitsNote(hits))
 		}
-		return output, fmt.Errorf("execution failed: %w\nOutput: %s", err, output)
+		return output, exitCode, hits, fmt.Errorf("execution failed: %w%s\nOutput: %s", err, limitsNote(hits), output)
 	}
 
-	return output, nil
+	return output, exitCode, hits, nil
 }
 
-// createTempScript creates a temporary script file
-func (e *Executor) createTempScript(content, ext string) (string, error) {
+// createTempScript writes a script to the executor's private directory and
+// returns the file, open and positioned at its start
+func (e *Executor) createTempScript(content, ext string) (*os.File, error) {
 	file, err := os.CreateTemp(e.tempDir, "script-*"+ext)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
-	defer file.Close()
-
-	// Unescape common escape sequences from blockchain data
-	unescapedContent := strings.ReplaceAll(content, "\\n", "\n")
-	unescapedContent = strings.ReplaceAll(unescapedContent, "\\t", "\t")
-	unescapedContent = strings.ReplaceAll(unescapedContent, "\\r", "\r")
 
-	if _, err := file.WriteString(unescapedContent); err != nil {
+	if _, err := file.WriteString(content); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
 		os.Remove(file.Name())
-		return "", fmt.Errorf("failed to write script: %w", err)
+		return nil, fmt.Errorf("failed to write script: %w", err)
 	}
 
-	return file.Name(), nil
+	return file, nil
 }
 
-// fetchFromURL fetches script content from URL
-func (e *Executor) fetchFromURL(url string) (string, error) {
+// cancelled marks a command that was cut short by ctx. Its lifecycle state
+// stays in flight, so the next start settles it.
+func (e *Executor) cancelled(result *types.ExecutionResult, startTime time.Time) *types.ExecutionResult {
+	result.Success = false
+	result.State = types.CommandStateAbandoned
+	result.Error = "execution cancelled: agent is shutting down"
+	result.Duration = time.Since(startTime)
+	logger.Log.WithField("commandId", result.CommandID.String()).Warn("Command cancelled")
+	return result
+}
+
+// abort fails a command that could not be started
+func (e *Executor) abort(result *types.ExecutionResult, err error, startTime time.Time) *types.ExecutionResult {
+	result.Success = false
+	result.State = types.CommandStateFailed
+	result.Error = err.Error()
+	result.Duration = time.Since(startTime)
+	logger.Log.WithError(err).WithField("commandId", result.CommandID.String()).Error("Command aborted before running")
+	return result
+}
+
+// fetchFromURL fetches script content from URL. A non-empty digest is the
+// hex SHA-256 the body must have.
+func (e *Executor) fetchFromURL(ctx context.Context, url, digest string) (string, error) {
 	logger.Log.WithField("url", url).Info("Fetching script from URL")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -233,6 +466,12 @@ func (e *Executor) fetchFromURL(url string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to read response: %w", err)
 	}
+	if digest != "" {
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, digest) {
+			return "", fmt.Errorf("script digest %s does not match signed digest %s", got, digest)
+		}
+	}
 
 	content := string(body)
 
@@ -244,7 +483,7 @@ func (e *Executor) fetchFromURL(url string) (string, error) {
 	return content, nil
 }
 
-// Cleanup cleans up temporary files
+// Cleanup removes the executor's script directory
 func (e *Executor) Cleanup() error {
 	return os.RemoveAll(e.tempDir)
 }
@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestExecutor(t *testing.T) *Executor {
+	t.Helper()
+	e, err := NewExecutor(time.Minute, 1)
+	if err != nil {
+		t.Fatalf("NewExecutor: %v", err)
+	}
+	t.Cleanup(func() { e.Cleanup() })
+	return e
+}
+
+func TestFetchFromURLChecksDigest(t *testing.T) {
+	const body = "ZWNobyBvawo=\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte(body))
+	digest := hex.EncodeToString(sum[:])
+
+	e := newTestExecutor(t)
+
+	tests := []struct {
+		name    string
+		digest  string
+		wantErr string
+	}{
+		{name: "no digest", digest: ""},
+		{name: "matching digest", digest: digest},
+		{name: "matching upper-case digest", digest: strings.ToUpper(digest)},
+		{name: "other digest", digest: strings.Repeat("0", 64), wantErr: "does not match signed digest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := e.fetchFromURL(context.Background(), srv.URL, tt.digest)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fetchFromURL = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchFromURL: %v", err)
+			}
+			if content != strings.TrimSpace(body) {
+				t.Errorf("content = %q", content)
+			}
+		})
+	}
+}
+
+func TestScriptsRunFromPrivateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("scripts are passed by path on windows")
+	}
+	e, other := newTestExecutor(t), newTestExecutor(t)
+
+	if e.tempDir == other.tempDir {
+		t.Fatalf("executors share script dir %s", e.tempDir)
+	}
+	info, err := os.Stat(e.tempDir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("script dir mode = %o, want 700", perm)
+	}
+
+	// The interpreter reads the open file rather than its name
+	cmd := &types.Command{ID: big.NewInt(1), CommandType: types.CommandTypeScript}
+	s, err := e.prepareScript(cmd, "#!/bin/sh\necho \"ok $0\"\n")
+	if err != nil {
+		t.Skipf("prepareScript: %v", err)
+	}
+	output, _, _, err := e.executeScript(context.Background(), s)
+	if err != nil {
+		t.Fatalf("executeScript: %v", err)
+	}
+	if !strings.HasPrefix(output, "ok /dev/fd/") {
+		t.Fatalf("output = %q", output)
+	}
+
+	// Cleaning up one executor leaves the other's scripts alone
+	if err := e.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if _, err := os.Stat(other.tempDir); err != nil {
+		t.Fatalf("other executor's script dir: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/session"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// identity is an account scripts run as. A nil identity is the agent's own.
+type identity struct {
+	username string
+	uid      uint32
+	gid      uint32
+	groups   []uint32
+	home     string
+	// session is the graphical session the script runs in, if any
+	session *session.Session
+}
+
+// inheritedEnv lists the agent's environment variables that scripts keep.
+// Everything else is dropped: godotenv loads .env into the environment, so
+// it holds secrets such as REPORT_SECRET and ACK_PRIVATE_KEY.
+var inheritedEnv = []string{"PATH", "LANG", "LC_ALL", "LC_CTYPE", "LC_MESSAGES", "TZ", "TERM"}
+
+// inheritedEnvWindows is inheritedEnv for Windows, where programs expect
+// the system folders in the environment
+var inheritedEnvWindows = []string{
+	"Path", "PATHEXT", "SystemRoot", "SystemDrive", "windir", "ComSpec", "TEMP", "TMP",
+	"USERPROFILE", "USERNAME", "USERDOMAIN", "HOMEDRIVE", "HOMEPATH", "APPDATA", "LOCALAPPDATA",
+	"ProgramData", "ProgramFiles", "ProgramFiles(x86)", "ProgramW6432", "CommonProgramFiles",
+	"CommonProgramFiles(x86)", "PSModulePath", "COMPUTERNAME", "OS", "NUMBER_OF_PROCESSORS",
+	"PROCESSOR_ARCHITECTURE",
+}
+
+// accountEnv describes the agent's own account; it is replaced when a script
+// runs as another user
+var accountEnv = []string{"HOME", "USER", "LOGNAME", "SHELL"}
+
+// SetRunAs runs scripts as user and group rather than the agent's own user.
+// user may be a name, a numeric ID or "desktop" for the console user. Scripts
+// whose SHA-256 digest is in elevated may still ask to run as the agent.
+func (e *Executor) SetRunAs(user, group string, elevated []string) error {
+	// A named user must exist now; the desktop user is looked up per command
+	if user != "" && user != string(types.RunAsDesktop) {
+		if _, err := lookupIdentity(user, group); err != nil {
+			return err
+		}
+	}
+	e.runAsUser = user
+	e.runAsGroup = group
+	e.elevated = make(map[string]bool)
+	for _, digest := range elevated {
+		e.elevated[strings.ToLower(digest)] = true
+	}
+	return nil
+}
+
+// identityFor returns the account a command's script runs as
+func (e *Executor) identityFor(cmd *types.Command, content string) (*identity, error) {
+	switch cmd.RunAs() {
+	case types.RunAsDefault:
+		if e.runAsUser == "" {
+			return nil, nil
+		}
+		if e.runAsUser == string(types.RunAsDesktop) {
+			return desktopIdentity()
+		}
+		return lookupIdentity(e.runAsUser, e.runAsGroup)
+	case types.RunAsDesktop:
+		return desktopIdentity()
+	case types.RunAsElevated:
+		digest := scriptDigest(content)
+		if !e.elevated[digest] {
+			return nil, fmt.Errorf("script is not allowed to run elevated (sha256 %s)", digest)
+		}
+		logger.Audit("command_elevated", map[string]interface{}{
+			"commandId": cmd.ID.String(),
+			"digest":    digest,
+		})
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown runAs %q", cmd.RunAs())
+	}
+}
+
+// scriptDigest returns the hex SHA-256 digest that identifies a script
+func scriptDigest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// desktopIdentity returns the account of the user logged in at the display,
+// placed in their graphical session
+func desktopIdentity() (*identity, error) {
+	s, err := session.Active()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find desktop user: %w", err)
+	}
+	id, err := lookupIdentity(s.Username, "")
+	if err != nil {
+		return nil, err
+	}
+	id.session = s
+	return id, nil
+}
+
+// scriptEnv returns the sanitized environment a script runs with
+func scriptEnv(id *identity) []string {
+	keep := inheritedEnv
+	if runtime.GOOS == "windows" {
+		keep = inheritedEnvWindows
+	}
+	if id == nil {
+		keep = append(keep[:len(keep):len(keep)], accountEnv...)
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		for _, k := range keep {
+			if strings.EqualFold(key, k) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	if id != nil {
+		env = append(env, "HOME="+id.home, "USER="+id.username, "LOGNAME="+id.username)
+		if id.session != nil {
+			env = append(env, id.session.Env...)
+		}
+	}
+	return env
+}
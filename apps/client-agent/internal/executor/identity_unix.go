@@ -0,0 +1,121 @@
+//go:build !windows
+
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lookupIdentity resolves a user and optional group, each given by name or ID
+func lookupIdentity(name, group string) (*identity, error) {
+	lookup := user.Lookup
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		lookup = user.LookupId
+	}
+	u, err := lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+
+	id := &identity{username: u.Username, home: u.HomeDir}
+	if id.uid, err = parseID(u.Uid); err != nil {
+		return nil, err
+	}
+	gid := u.Gid
+	if group != "" {
+		lookupGroup := user.LookupGroup
+		if _, err := strconv.ParseUint(group, 10, 32); err == nil {
+			lookupGroup = user.LookupGroupId
+		}
+		g, err := lookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up group %s: %w", group, err)
+		}
+		gid = g.Gid
+	}
+	if id.gid, err = parseID(gid); err != nil {
+		return nil, err
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups of %s: %w", u.Username, err)
+	}
+	for _, g := range groupIDs {
+		n, err := parseID(g)
+		if err != nil {
+			return nil, err
+		}
+		id.groups = append(id.groups, n)
+	}
+	return id, nil
+}
+
+func parseID(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user or group ID %q", s)
+	}
+	return uint32(n), nil
+}
+
+// apply makes cmd run as the identity and hands it the open script file. It
+// returns the path the interpreter reads the script from and a function
+// removing anything apply created.
+func (id *identity) apply(cmd *exec.Cmd, script *os.File) (string, func(), error) {
+	if err := script.Chown(int(id.uid), int(id.gid)); err != nil {
+		return "", nil, fmt.Errorf("failed to hand script to %s: %w", id.username, err)
+	}
+	// The agent's working directory may not be readable by the user
+	cmd.Dir = "/"
+	if info, err := os.Stat(id.home); err == nil && info.IsDir() {
+		cmd.Dir = id.home
+	}
+	if id.session != nil && enterSession(cmd, id) {
+		// sudo closes inherited descriptors, so the user gets its own copy
+		return id.copyScript(script)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: id.uid, Gid: id.gid, Groups: id.groups},
+	}
+	return scriptArg(cmd, script), func() {}, nil
+}
+
+// copyScript copies a script into a new directory only the identity and the
+// agent can open. The script runs as the identity, so nobody who could swap
+// it gains anything by doing so.
+func (id *identity) copyScript(script *os.File) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "phd-client-agent-"+id.username+"-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create script dir for %s: %w", id.username, err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	path := filepath.Join(dir, filepath.Base(script.Name()))
+	info, err := script.Stat()
+	var content []byte
+	if err == nil {
+		content, err = io.ReadAll(io.NewSectionReader(script, 0, info.Size()))
+	}
+	if err == nil {
+		err = os.WriteFile(path, content, 0600)
+	}
+	if err == nil {
+		err = os.Chown(path, int(id.uid), int(id.gid))
+	}
+	if err == nil {
+		err = os.Chown(dir, int(id.uid), int(id.gid))
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to hand script to %s: %w", id.username, err)
+	}
+	return path, cleanup, nil
+}
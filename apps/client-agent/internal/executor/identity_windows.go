@@ -0,0 +1,17 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// lookupIdentity is not supported on Windows, which has no setuid
+func lookupIdentity(name, group string) (*identity, error) {
+	return nil, fmt.Errorf("running scripts as %s is not supported on windows", name)
+}
+
+// apply is never reached on Windows, since no identity can be looked up
+func (id *identity) apply(cmd *exec.Cmd, script *os.File) (string, func(), error) {
+	return "", nil, fmt.Errorf("running scripts as %s is not supported on windows", id.username)
+}
@@ -0,0 +1,157 @@
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Interpreter runs scripts of one language
+type Interpreter struct {
+	Name string
+	// Binaries are tried in order when looking the interpreter up on PATH
+	Binaries []string
+	// Ext is the extension given to the script file
+	Ext string
+	// Args are passed first, before any arguments from the shebang line
+	Args []string
+	// ScriptFlag, if set, comes right before the script file
+	ScriptFlag string
+	// OS restricts the interpreter to the listed platforms; empty means any
+	OS []string
+}
+
+var interpreters = map[string]*Interpreter{
+	"bash":       {Name: "bash", Binaries: []string{"bash"}, Ext: ".sh"},
+	"sh":         {Name: "sh", Binaries: []string{"sh"}, Ext: ".sh"},
+	"zsh":        {Name: "zsh", Binaries: []string{"zsh"}, Ext: ".zsh"},
+	"python3":    {Name: "python3", Binaries: pythonBinaries(), Ext: ".py"},
+	"pwsh":       {Name: "pwsh", Binaries: []string{"pwsh"}, Ext: ".ps1", Args: []string{"-NoProfile", "-ExecutionPolicy", "Bypass"}, ScriptFlag: "-File"},
+	"powershell": {Name: "powershell", Binaries: []string{"powershell"}, Ext: ".ps1", Args: []string{"-NoProfile", "-ExecutionPolicy", "Bypass"}, ScriptFlag: "-File", OS: []string{"windows"}},
+	"osascript":  {Name: "osascript", Binaries: []string{"osascript"}, Ext: ".applescript", OS: []string{"darwin"}},
+}
+
+// aliases maps other names found in shebang lines to registry names
+var aliases = map[string]string{
+	"python":         "python3",
+	"powershell.exe": "powershell",
+	"pwsh.exe":       "pwsh",
+}
+
+// pythonBinaries returns the names Python 3 is installed under. On Windows
+// the python.org installer only provides python.exe.
+func pythonBinaries() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"python3", "python"}
+	}
+	return []string{"python3"}
+}
+
+// defaultInterpreter runs scripts with neither a shebang nor an interpreter field
+func defaultInterpreter() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+// LookupInterpreter returns a registered interpreter by name
+func LookupInterpreter(name string) (*Interpreter, bool) {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "python3.") {
+		name = "python3"
+	}
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	interp, ok := interpreters[name]
+	return interp, ok
+}
+
+// Path returns the interpreter's executable, or an error if it is not
+// available on this machine
+func (i *Interpreter) Path() (string, error) {
+	if len(i.OS) > 0 && !contains(i.OS, runtime.GOOS) {
+		return "", fmt.Errorf("interpreter %s is not supported on %s", i.Name, runtime.GOOS)
+	}
+	for _, bin := range i.Binaries {
+		if path, err := exec.LookPath(bin); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("interpreter %s is not installed", i.Name)
+}
+
+// scriptArgs returns the interpreter's arguments up to the script file, with
+// the arguments from the script's shebang line in between. PowerShell treats
+// everything after -File as arguments to the script.
+func (i *Interpreter) scriptArgs(shebangArgs []string) []string {
+	args := append(append([]string{}, i.Args...), shebangArgs...)
+	if i.ScriptFlag != "" {
+		args = append(args, i.ScriptFlag)
+	}
+	return args
+}
+
+// AvailableInterpreters lists the registered interpreters installed on this machine
+func AvailableInterpreters() []string {
+	var names []string
+	for name, interp := range interpreters {
+		if _, err := interp.Path(); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveInterpreter picks the interpreter for a script: the explicit name if
+// given, else the script's shebang, else the platform default. Arguments on
+// the shebang line are passed to the interpreter.
+func resolveInterpreter(name, script string) (*Interpreter, []string, error) {
+	var args []string
+	if name == "" {
+		name, args = parseShebang(script)
+	}
+	if name == "" {
+		name = defaultInterpreter()
+	}
+	interp, ok := LookupInterpreter(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported interpreter %q", name)
+	}
+	return interp, args, nil
+}
+
+// parseShebang returns the interpreter named on a script's #! line and its
+// arguments. "#!/usr/bin/env python3" and "#!/usr/bin/python3" both name python3.
+func parseShebang(script string) (string, []string) {
+	if !strings.HasPrefix(script, "#!") {
+		return "", nil
+	}
+	line, _, _ := strings.Cut(script[2:], "\n")
+	fields := strings.Fields(strings.TrimSuffix(line, "\r"))
+	if len(fields) > 0 && filepath.Base(fields[0]) == "env" {
+		fields = fields[1:]
+		// env -S splits the rest of the line into arguments
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return filepath.Base(fields[0]), fields[1:]
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseShebang(t *testing.T) {
+	tests := []struct {
+		script string
+		name   string
+		args   string
+	}{
+		{"echo ok\n", "", ""},
+		{"#!/bin/bash\necho ok\n", "bash", ""},
+		{"#!/bin/bash -e\necho ok\n", "bash", "-e"},
+		{"#!/bin/bash -e\r\necho ok\r\n", "bash", "-e"},
+		{"#!/usr/bin/env python3\nprint('ok')\n", "python3", ""},
+		{"#!/usr/bin/env -S python3 -u\nprint('ok')\n", "python3", "-u"},
+		{"#!/usr/bin/env -S bash -e -u\necho ok\n", "bash", "-e -u"},
+		{"#!/usr/bin/env pwsh -NoLogo\nWrite-Output ok\n", "pwsh", "-NoLogo"},
+		{"#! /usr/local/bin/pwsh\nWrite-Output ok\n", "pwsh", ""},
+		{"#!/usr/bin/env\necho ok\n", "", ""},
+	}
+
+	for _, tt := range tests {
+		name, args := parseShebang(tt.script)
+		if name != tt.name || strings.Join(args, " ") != tt.args {
+			t.Errorf("parseShebang(%q) = %q, %q, want %q, %q", tt.script, name, args, tt.name, tt.args)
+		}
+	}
+}
+
+func TestScriptArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		interpreter string
+		script      string
+		want        string
+	}{
+		{"bash with shebang flag", "", "#!/bin/bash -e\necho ok\n", "-e"},
+		{"env -S", "", "#!/usr/bin/env -S python3 -u\nprint('ok')\n", "-u"},
+		{"pwsh without shebang args", "pwsh", "Write-Output ok\n", "-NoProfile -ExecutionPolicy Bypass -File"},
+		{"pwsh shebang args go before -File", "", "#!/usr/bin/env pwsh -NoLogo\nWrite-Output ok\n", "-NoProfile -ExecutionPolicy Bypass -NoLogo -File"},
+		{"explicit interpreter ignores the shebang", "sh", "#!/bin/bash -e\necho ok\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interp, args, err := resolveInterpreter(tt.interpreter, tt.script)
+			if err != nil {
+				t.Fatalf("resolveInterpreter: %v", err)
+			}
+			if got := strings.Join(interp.scriptArgs(args), " "); got != tt.want {
+				t.Errorf("arguments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
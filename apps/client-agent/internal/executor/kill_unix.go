@@ -0,0 +1,42 @@
+//go:build !windows
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// defaultKillGrace is how long processes get between SIGTERM and SIGKILL
+const defaultKillGrace = 5 * time.Second
+
+// killTree starts cmd in its own process group and makes cancellation
+// signal the whole group, so children the script started in the background
+// do not outlive it. The group gets SIGTERM, then SIGKILL after grace.
+// The returned stop must be called once cmd.Wait returns, so a pending
+// SIGKILL never reaches a group ID the OS has handed out again.
+func killTree(cmd *exec.Cmd, grace time.Duration) (stop func()) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	// Wait does not return before Cancel has, so stop sees the timer
+	var timer *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		timer = time.AfterFunc(grace, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	// Stop waiting for output held open by processes that ignore both signals
+	cmd.WaitDelay = waitDelay(grace)
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package executor
+
+import (
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// defaultKillGrace is how long Wait lets output pipes drain after the tree is killed
+const defaultKillGrace = 5 * time.Second
+
+// killTree makes cancellation kill cmd and every process it started.
+// Windows has no SIGTERM, so the tree is killed at once and stop has
+// nothing to do.
+func killTree(cmd *exec.Cmd, grace time.Duration) (stop func()) {
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+	cmd.WaitDelay = waitDelay(grace)
+	return func() {}
+}
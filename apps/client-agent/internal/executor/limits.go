@@ -0,0 +1,77 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// SetLimits sets the default resource limits of every script. Memory, CPU
+// and process limits are enforced with a cgroup per script where cgroup v2
+// is available, and memory falls back to an rlimit elsewhere. File size and
+// open file limits are always rlimits.
+func (e *Executor) SetLimits(defaults types.Limits) {
+	e.limits = defaults
+	if needsCgroup(defaults) {
+		e.scriptCgroups()
+	}
+}
+
+// scriptCgroups returns the per-script cgroups, or nil where they are not
+// available. They are only set up once a script needs one.
+func (e *Executor) scriptCgroups() *cgroups {
+	e.cgroupsOnce.Do(func() {
+		cg, err := newCgroups()
+		if err != nil {
+			logger.Log.WithError(err).Warn("cgroup v2 not available, CPU and process limits will not be enforced")
+			return
+		}
+		e.cgroups = cg
+	})
+	return e.cgroups
+}
+
+// limitsFor returns a command's limits: the defaults, with any field the
+// payload sets replaced
+func (e *Executor) limitsFor(cmd *types.Command) types.Limits {
+	limits := e.limits
+	override := cmd.Limits()
+	if override == nil {
+		return limits
+	}
+	if override.MemoryMax > 0 {
+		limits.MemoryMax = override.MemoryMax
+	}
+	if override.CPUMax > 0 {
+		limits.CPUMax = override.CPUMax
+	}
+	if override.PidsMax > 0 {
+		limits.PidsMax = override.PidsMax
+	}
+	if override.FileSizeMax > 0 {
+		limits.FileSizeMax = override.FileSizeMax
+	}
+	if override.OpenFilesMax > 0 {
+		limits.OpenFilesMax = override.OpenFilesMax
+	}
+	return limits
+}
+
+// needsCgroup reports whether any limit is enforced through a cgroup
+func needsCgroup(limits types.Limits) bool {
+	return limits.MemoryMax > 0 || limits.CPUMax > 0 || limits.PidsMax > 0
+}
+
+// limitsNote describes the limits a script hit, for its error message
+func limitsNote(hits []types.LimitHit) string {
+	if len(hits) == 0 {
+		return ""
+	}
+	names := make([]string, len(hits))
+	for i, hit := range hits {
+		names[i] = string(hit)
+	}
+	return fmt.Sprintf(" (limits hit: %s)", strings.Join(names, ", "))
+}
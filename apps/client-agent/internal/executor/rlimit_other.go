@@ -0,0 +1,34 @@
+//go:build !linux && !darwin
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// LimitedCommand is the agent subcommand that applies rlimits on Linux and macOS
+const LimitedCommand = "exec-limited"
+
+// wrapRlimits warns that rlimits are not applied on this platform
+func wrapRlimits(cmd *exec.Cmd, limits types.Limits, memory bool) error {
+	if limits != (types.Limits{}) {
+		logger.Log.WithField("os", runtime.GOOS).Warn("Script resource limits are not supported on this platform")
+	}
+	return nil
+}
+
+// RunLimited is not supported on this platform
+func RunLimited(args []string) int {
+	fmt.Fprintf(os.Stderr, "%s is not supported on %s\n", LimitedCommand, runtime.GOOS)
+	return 2
+}
+
+func fileSizeHit(state *os.ProcessState) bool {
+	return false
+}
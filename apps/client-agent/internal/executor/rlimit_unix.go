@@ -0,0 +1,96 @@
+//go:build linux || darwin
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/phd/client-agent/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// LimitedCommand is the agent subcommand that sets rlimits and then execs a
+// script's interpreter, since Go cannot set rlimits on a child directly
+const LimitedCommand = "exec-limited"
+
+// rlimitResources maps the names used on the exec-limited command line
+var rlimitResources = map[string]int{
+	"as":     unix.RLIMIT_AS,
+	"fsize":  unix.RLIMIT_FSIZE,
+	"nofile": unix.RLIMIT_NOFILE,
+}
+
+// wrapRlimits makes cmd start through the exec-limited subcommand when any
+// rlimit applies. memory selects an address space limit for MemoryMax, used
+// when no cgroup enforces it.
+func wrapRlimits(cmd *exec.Cmd, limits types.Limits, memory bool) error {
+	var specs []string
+	if memory && limits.MemoryMax > 0 {
+		specs = append(specs, fmt.Sprintf("as=%d", limits.MemoryMax<<20))
+	}
+	if limits.FileSizeMax > 0 {
+		specs = append(specs, fmt.Sprintf("fsize=%d", limits.FileSizeMax<<20))
+	}
+	if limits.OpenFilesMax > 0 {
+		specs = append(specs, fmt.Sprintf("nofile=%d", limits.OpenFilesMax))
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	cmd.Args = append([]string{self, LimitedCommand, strings.Join(specs, ","), "--", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	return nil
+}
+
+// RunLimited implements the exec-limited subcommand. args are the limits as
+// name=value pairs, "--", then the program and its arguments. It only
+// returns if the program cannot be started.
+func RunLimited(args []string) int {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintf(os.Stderr, "usage: %s name=value[,...] -- program [args...]\n", LimitedCommand)
+		return 2
+	}
+
+	for _, spec := range strings.Split(args[0], ",") {
+		name, value, _ := strings.Cut(spec, "=")
+		resource, ok := rlimitResources[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown limit %q\n", name)
+			return 2
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid limit %q\n", spec)
+			return 2
+		}
+		// An unprivileged script user cannot raise the hard limit it inherited
+		var current unix.Rlimit
+		if err := unix.Getrlimit(resource, &current); err == nil && n > current.Max {
+			n = current.Max
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: n, Max: n}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set %s limit: %v\n", name, err)
+			return 126
+		}
+	}
+
+	err := syscall.Exec(args[2], args[2:], os.Environ())
+	fmt.Fprintf(os.Stderr, "failed to run %s: %v\n", args[2], err)
+	return 126
+}
+
+// fileSizeHit reports whether the script was killed for exceeding its file size limit
+func fileSizeHit(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXFSZ
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// scriptArg hands cmd the open script file as an inherited descriptor and
+// returns the path the interpreter opens it by. The interpreter reads the
+// file that was written, whatever happens to its name.
+func scriptArg(cmd *exec.Cmd, script *os.File) string {
+	cmd.ExtraFiles = append(cmd.ExtraFiles, script)
+	return fmt.Sprintf("/dev/fd/%d", 2+len(cmd.ExtraFiles))
+}
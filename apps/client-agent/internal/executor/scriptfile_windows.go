@@ -0,0 +1,12 @@
+package executor
+
+import (
+	"os"
+	"os/exec"
+)
+
+// scriptArg returns the script's path. Windows has no /dev/fd, and a file
+// open in the agent cannot be replaced.
+func scriptArg(cmd *exec.Cmd, script *os.File) string {
+	return script.Name()
+}
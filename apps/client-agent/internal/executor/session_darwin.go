@@ -0,0 +1,17 @@
+package executor
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// enterSession runs cmd in the user's GUI bootstrap namespace, without which
+// osascript cannot reach the desktop. launchctl asuser needs root, so sudo
+// switches to the user inside it.
+func enterSession(cmd *exec.Cmd, id *identity) bool {
+	uid := strconv.FormatUint(uint64(id.uid), 10)
+	args := []string{"/bin/launchctl", "asuser", uid, "/usr/bin/sudo", "-H", "-u", "#" + uid, "--", cmd.Path}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = "/bin/launchctl"
+	return true
+}
@@ -0,0 +1,53 @@
+// Package fsutil writes files so they survive a crash or power loss
+package fsutil
+
+import "os"
+
+// WriteSynced writes data to path, creating or truncating it with mode 0600,
+// and flushes it to disk before returning
+func WriteSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SyncDir flushes a directory so renames and removals survive a power loss.
+// Not every platform can sync a directory, so failures are ignored.
+func SyncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// CreateExclusive creates path with mode 0600 and writes data to it, flushed
+// to disk. It fails with an error matching os.IsExist if path already exists,
+// so when several processes create the same file only the first one writes
+// it. A failed write leaves no file behind.
+func CreateExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
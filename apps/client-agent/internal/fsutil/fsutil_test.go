@@ -0,0 +1,27 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCreateExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client-id")
+
+	if err := CreateExclusive(path, []byte("first\n")); err != nil {
+		t.Fatalf("CreateExclusive: %v", err)
+	}
+	if err := CreateExclusive(path, []byte("second\n")); !os.IsExist(err) {
+		t.Fatalf("second CreateExclusive = %v, want an exists error", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "first\n" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("mode = %o, want 600", info.Mode().Perm())
+	}
+}
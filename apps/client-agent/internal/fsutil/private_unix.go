@@ -0,0 +1,23 @@
+//go:build !windows
+
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// CheckPrivateDir makes sure dir is a real directory owned by the current
+// user with mode 0700, so no other user can list or change its entries
+func CheckPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %w", dir, err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s is not a directory private to the agent", dir)
+	}
+	return nil
+}
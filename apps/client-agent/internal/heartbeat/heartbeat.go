@@ -0,0 +1,132 @@
+package heartbeat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/internal/reporter"
+	"github.com/phd/client-agent/internal/storage"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// Heartbeat is the liveness and inventory report sent to the backend
+type Heartbeat struct {
+	ClientID       string    `json:"clientId"`
+	OS             string    `json:"os"`
+	OSVersion      string    `json:"osVersion"`
+	Arch           string    `json:"arch"`
+	Hostname       string    `json:"hostname"`
+	AgentVersion   string    `json:"agentVersion"`
+	UptimeSeconds  int64     `json:"uptimeSeconds"`
+	LastCommandID  string    `json:"lastCommandId"`
+	LastBlock      uint64    `json:"lastBlock"`
+	PendingReports int       `json:"pendingReports"`
+	PauseReason    string    `json:"pauseReason,omitempty"`
+	SentAt         time.Time `json:"sentAt"`
+}
+
+// Sender periodically posts a signed heartbeat to the backend. Missed
+// heartbeats are not queued, the next one supersedes them.
+type Sender struct {
+	url        string
+	secret     []byte
+	interval   time.Duration
+	info       *types.ClientInfo
+	version    string
+	startedAt  time.Time
+	storage    *storage.Storage
+	outbox     interface{ Depth() (int, int64) }
+	httpClient *http.Client
+}
+
+// NewSender creates a heartbeat sender posting to url every interval
+func NewSender(url, secret string, interval time.Duration, info *types.ClientInfo, version string, store *storage.Storage) *Sender {
+	return &Sender{
+		url:        url,
+		secret:     []byte(secret),
+		interval:   interval,
+		info:       info,
+		version:    version,
+		startedAt:  time.Now(),
+		storage:    store,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SetOutbox reports the depth of a result queue in heartbeats
+func (s *Sender) SetOutbox(outbox interface{ Depth() (int, int64) }) {
+	s.outbox = outbox
+}
+
+// Run sends a heartbeat immediately and then on every interval until ctx is
+// cancelled
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.send(ctx); err != nil {
+			logger.Log.WithError(err).Warn("Failed to send heartbeat")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect builds the current heartbeat
+func (s *Sender) Collect() *Heartbeat {
+	lastBlock, _ := s.storage.GetLastBlock()
+
+	hb := &Heartbeat{
+		ClientID:      s.info.ClientID,
+		OS:            s.info.OS,
+		OSVersion:     s.info.OSVersion,
+		Arch:          s.info.Arch,
+		Hostname:      s.info.Hostname,
+		AgentVersion:  s.version,
+		UptimeSeconds: int64(time.Since(s.startedAt).Seconds()),
+		LastCommandID: s.storage.GetLastCommandID().String(),
+		LastBlock:     lastBlock,
+		PauseReason:   s.storage.PauseReason(),
+		SentAt:        time.Now().UTC(),
+	}
+	if s.outbox != nil {
+		hb.PendingReports, _ = s.outbox.Depth()
+	}
+	return hb
+}
+
+func (s *Sender) send(ctx context.Context) error {
+	body, err := json.Marshal(s.Collect())
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	reporter.SignRequest(req, s.secret, s.info.ClientID, body)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post heartbeat: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
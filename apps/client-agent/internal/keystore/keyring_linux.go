@@ -0,0 +1,39 @@
+//go:build linux
+
+package keystore
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// loadKeyring reads a hex key of type "user" from the session, user or
+// persistent kernel keyring, e.g. one added at boot with
+//
+//	keyctl add user phd-client-agent:state <hex key> @u
+func loadKeyring() ([]byte, error) {
+	rings := []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING}
+	if persistent, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_USER_KEYRING, 0, 0); err == nil {
+		rings = append(rings, persistent)
+	}
+
+	for _, ring := range rings {
+		id, err := unix.KeyctlSearch(ring, "user", keyDescription, 0)
+		if err != nil {
+			continue
+		}
+
+		buf := make([]byte, 256)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key from keyring: %w", err)
+		}
+		if n > len(buf) {
+			return nil, fmt.Errorf("keyring entry %s is too large", keyDescription)
+		}
+		return decode(buf[:n])
+	}
+
+	return nil, fmt.Errorf("key %s not found in the kernel keyring", keyDescription)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package keystore
+
+import "fmt"
+
+// loadKeyring is only available on Linux
+func loadKeyring() ([]byte, error) {
+	return nil, fmt.Errorf("the kernel keyring is only supported on Linux")
+}
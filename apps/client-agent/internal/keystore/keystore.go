@@ -0,0 +1,185 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/phd/client-agent/internal/fsutil"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// KeySize is the length of the state key
+const KeySize = 32
+
+// keyDescription names the key in the kernel keyring and Secret Service
+const keyDescription = "phd-client-agent:state"
+
+// Load returns the state encryption key from the configured source. The file
+// and Secret Service sources create a key on first use; the kernel keyring
+// does not survive a reboot, so its key must be provisioned at boot.
+func Load(source types.KeySource, path string) ([]byte, error) {
+	switch source {
+	case types.KeySourceFile:
+		return loadFile(path)
+	case types.KeySourceKeyring:
+		return loadKeyring()
+	case types.KeySourceSecretService:
+		return loadSecretService()
+	default:
+		return nil, fmt.Errorf("unknown key source %q", source)
+	}
+}
+
+// loadFile reads a hex key from path, creating it if it does not exist. The
+// file must not be accessible to group or others.
+func loadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat key file: %w", err)
+		}
+		if perm := info.Mode().Perm(); perm&0077 != 0 {
+			return nil, fmt.Errorf("key file %s has mode %o, it must not be accessible by group or others", path, perm)
+		}
+	}
+
+	return decode(data)
+}
+
+func createFile(path string) ([]byte, error) {
+	key, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key dir: %w", err)
+	}
+
+	// Another agent starting at the same time may have written its key first
+	err = fsutil.CreateExclusive(path, []byte(hex.EncodeToString(key)+"\n"))
+	if os.IsExist(err) {
+		return loadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+
+	logger.Log.WithField("file", path).Info("Created state encryption key")
+	return key, nil
+}
+
+// Relocate moves a key file from oldPath to path unless path already exists.
+// Earlier versions kept the key next to the state database by default.
+func Relocate(oldPath, path string) error {
+	if oldPath == path {
+		return nil
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+	data, err := os.ReadFile(oldPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	if _, err := decode(data); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key dir: %w", err)
+	}
+	err = fsutil.CreateExclusive(path, data)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	if err := os.Remove(oldPath); err != nil {
+		return fmt.Errorf("failed to remove old key file: %w", err)
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"from": oldPath,
+		"to":   path,
+	}).Info("Moved state encryption key out of the data directory")
+	return nil
+}
+
+// loadSecretService reads the key through secret-tool, storing a new one if
+// the collection has none
+func loadSecretService() ([]byte, error) {
+	attrs := []string{"service", "phd-client-agent", "key", "state"}
+
+	var stdout, stderr bytes.Buffer
+	lookup := exec.Command("secret-tool", append([]string{"lookup"}, attrs...)...)
+	lookup.Stdout = &stdout
+	lookup.Stderr = &stderr
+	err := lookup.Run()
+	if err == nil && stdout.Len() > 0 {
+		return decode(stdout.Bytes())
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("failed to run secret-tool: %w", err)
+	}
+	if stderr.Len() > 0 {
+		return nil, fmt.Errorf("secret-tool lookup failed: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	// Not found: store a new key
+	key, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	store := exec.Command("secret-tool", append([]string{"store", "--label=PHD client agent state key"}, attrs...)...)
+	store.Stdin = strings.NewReader(hex.EncodeToString(key))
+	if out, err := store.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to store key with secret-tool: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	logger.Log.Info("Created state encryption key in Secret Service")
+	return key, nil
+}
+
+func generate() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// decode parses a hex key, tolerating surrounding whitespace
+func decode(data []byte) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("state key is not valid hex: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("state key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
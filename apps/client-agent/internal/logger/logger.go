@@ -9,6 +9,9 @@ import (
 
 var Log *logrus.Logger
 
+// auditLog records security decisions as JSON lines, separate from Log
+var auditLog *logrus.Logger
+
 // Init initializes the logger
 func Init(level, logFile string) error {
 	Log = logrus.New()
@@ -39,3 +42,31 @@ func Init(level, logFile string) error {
 
 	return nil
 }
+
+// InitAudit opens the audit log. An empty path disables the audit file, but
+// audit events are still written to the main log.
+func InitAudit(auditFile string) error {
+	auditLog = logrus.New()
+	auditLog.SetFormatter(&logrus.JSONFormatter{})
+
+	if auditFile == "" {
+		auditLog.SetOutput(io.Discard)
+		return nil
+	}
+
+	file, err := os.OpenFile(auditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog.SetOutput(file)
+
+	return nil
+}
+
+// Audit records a security-relevant event in the audit log and the main log
+func Audit(event string, fields map[string]interface{}) {
+	if auditLog != nil {
+		auditLog.WithFields(fields).Info(event)
+	}
+	Log.WithFields(fields).Warn("Audit: " + event)
+}
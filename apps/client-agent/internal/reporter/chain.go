@@ -0,0 +1,127 @@
+package reporter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// ackABI is the acknowledgement function the ack contract must expose. The
+// DeviceControl contract does not have it, so acknowledgements go to a
+// separately deployed contract.
+const ackABI = `[
+  {
+    "type": "function",
+    "name": "acknowledge",
+    "inputs": [
+      {"name": "commandId", "type": "uint256", "internalType": "uint256"},
+      {"name": "success", "type": "bool", "internalType": "bool"},
+      {"name": "backendCommandId", "type": "string", "internalType": "string"}
+    ],
+    "outputs": [],
+    "stateMutability": "nonpayable"
+  }
+]`
+
+// TxClient is the chain access acknowledgements need. blockchain.MultiClient
+// serves it with failover across the RPC endpoints.
+type TxClient interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	SendTransaction(ctx context.Context, tx *ethtypes.Transaction) error
+}
+
+// ChainReporter acknowledges results with an on-chain transaction
+type ChainReporter struct {
+	client   TxClient
+	contract common.Address
+	abi      abi.ABI
+	key      *ecdsa.PrivateKey
+	from     common.Address
+}
+
+// NewChainReporter creates a reporter sending acknowledge transactions to
+// contractAddress through client, signed with the hex-encoded private key
+func NewChainReporter(client TxClient, contractAddress, privateKey string) (*ChainReporter, error) {
+	parsed, err := abi.JSON(strings.NewReader(ackABI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ABI: %w", err)
+	}
+
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(privateKey, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ack private key: %w", err)
+	}
+
+	return &ChainReporter{
+		client:   client,
+		contract: common.HexToAddress(contractAddress),
+		abi:      parsed,
+		key:      key,
+		from:     crypto.PubkeyToAddress(key.PublicKey),
+	}, nil
+}
+
+// Report sends an acknowledge transaction without waiting for it to be mined
+func (c *ChainReporter) Report(ctx context.Context, result *types.ExecutionResult) error {
+	data, err := c.abi.Pack("acknowledge", result.CommandID, result.Success, result.BackendCommandID)
+	if err != nil {
+		return fmt.Errorf("failed to pack acknowledge: %w", err)
+	}
+
+	chainID, err := c.client.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain id: %w", err)
+	}
+	nonce, err := c.client.PendingNonceAt(ctx, c.from)
+	if err != nil {
+		return fmt.Errorf("failed to get nonce: %w", err)
+	}
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get gas price: %w", err)
+	}
+	gas, err := c.client.EstimateGas(ctx, ethereum.CallMsg{
+		From: c.from,
+		To:   &c.contract,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to estimate gas: %w", err)
+	}
+
+	tx := ethtypes.NewTx(&ethtypes.LegacyTx{
+		Nonce:    nonce,
+		To:       &c.contract,
+		Gas:      gas,
+		GasPrice: gasPrice,
+		Data:     data,
+	})
+	signed, err := ethtypes.SignTx(tx, ethtypes.LatestSignerForChainID(chainID), c.key)
+	if err != nil {
+		return fmt.Errorf("failed to sign acknowledge: %w", err)
+	}
+
+	if err := c.client.SendTransaction(ctx, signed); err != nil {
+		return fmt.Errorf("failed to send acknowledge: %w", err)
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"commandId": result.CommandID.String(),
+		"txHash":    signed.Hash().Hex(),
+	}).Info("Sent on-chain acknowledgement")
+
+	return nil
+}
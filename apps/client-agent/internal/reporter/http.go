@@ -0,0 +1,200 @@
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// HTTPReporter posts signed JSON results to the backend. Every result is
+// written to the on-disk outbox first and delivered from there in order, so
+// results produced while the machine is offline are sent once it reconnects.
+type HTTPReporter struct {
+	url         string
+	secret      []byte
+	clientID    string
+	outputLimit int
+	httpClient  *http.Client
+	outbox      *Outbox
+	wake        chan struct{}
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// Delivery backoff after a failed attempt
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// NewHTTPReporter creates a reporter posting to url. Bodies are signed with
+// HMAC-SHA256 using secret, if one is given.
+func NewHTTPReporter(url, secret, clientID string, outputLimit int, outbox *Outbox) *HTTPReporter {
+	return &HTTPReporter{
+		url:         url,
+		secret:      []byte(secret),
+		clientID:    clientID,
+		outputLimit: outputLimit,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		outbox:      outbox,
+		wake:        make(chan struct{}, 1),
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+	}
+}
+
+// Report queues a result for delivery. It returns once the result is
+// durably stored, not when the backend has received it.
+func (h *HTTPReporter) Report(ctx context.Context, result *types.ExecutionResult) error {
+	body, err := json.Marshal(NewReport(h.clientID, result, h.outputLimit))
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	if err := h.outbox.Put(result.CommandID.String(), body); err != nil {
+		return fmt.Errorf("failed to queue report: %w", err)
+	}
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued reports until ctx is cancelled, backing off
+// exponentially while the backend is unreachable
+func (h *HTTPReporter) Run(ctx context.Context) {
+	backoff := h.minBackoff
+	for {
+		if err := h.flush(ctx); err != nil {
+			entries, size := h.outbox.Depth()
+			logger.Log.WithError(err).WithFields(map[string]interface{}{
+				"queued":  entries,
+				"bytes":   size,
+				"retryIn": backoff.String(),
+			}).Warn("Failed to deliver results, will retry")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, h.maxBackoff)
+			continue
+		}
+
+		backoff = h.minBackoff
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.wake:
+		}
+	}
+}
+
+// Depth returns the number and total size of undelivered reports
+func (h *HTTPReporter) Depth() (int, int64) {
+	return h.outbox.Depth()
+}
+
+// flush sends queued reports in order, stopping at the first failure
+func (h *HTTPReporter) flush(ctx context.Context) error {
+	entries, err := h.outbox.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		body, err := h.outbox.Read(entry)
+		if err != nil {
+			logger.Log.WithError(err).WithField("entry", entry).Warn("Dropping unreadable outbox entry")
+			_ = h.outbox.Remove(entry)
+			continue
+		}
+
+		if err := h.send(ctx, body); err != nil {
+			var rejected *rejectedError
+			if !errors.As(err, &rejected) {
+				return err
+			}
+			// Retrying a report the backend refuses would block the queue
+			logger.Log.WithError(err).WithField("entry", entry).Error("Backend rejected report, dropping it")
+		}
+
+		if err := h.outbox.Remove(entry); err != nil {
+			return fmt.Errorf("failed to remove delivered outbox entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rejectedError is a client error from the backend that retrying won't fix
+type rejectedError struct {
+	status int
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("report rejected with status code: %d", e.status)
+}
+
+// send posts one signed report body
+func (h *HTTPReporter) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	SignRequest(req, h.secret, h.clientID, body)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post report: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &rejectedError{status: resp.StatusCode}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignRequest sets the client, timestamp and signature headers on a JSON
+// request to the backend
+func SignRequest(req *http.Request, secret []byte, clientID string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PHD-Client-ID", clientID)
+	req.Header.Set("X-PHD-Timestamp", timestamp)
+	if len(secret) > 0 {
+		req.Header.Set("X-PHD-Signature", "sha256="+Sign(secret, timestamp, body))
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body", so the backend can
+// authenticate the client and reject replayed requests
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package reporter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phd/client-agent/internal/fsutil"
+	"github.com/phd/client-agent/internal/logger"
+)
+
+// Outbox is a durable queue of reports waiting for delivery. Each report is
+// one file, named so that listing them returns the original order. Entries
+// are only removed once the backend has acknowledged them.
+type Outbox struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+// NewOutbox creates an outbox in dir holding at most maxSize bytes
+// (0 = unlimited). Partial writes left by a crash are discarded.
+func NewOutbox(dir string, maxSize int64) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox dir: %w", err)
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan outbox dir: %w", err)
+	}
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	return &Outbox{dir: dir, maxSize: maxSize}, nil
+}
+
+// Put stores a report body under key. A key that is already queued is not
+// stored twice. The file is synced under a temporary name and renamed, so a
+// crash leaves either the whole entry or nothing.
+func (o *Outbox) Put(key string, body []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.list()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entryKey(entry) == key {
+			return nil
+		}
+	}
+
+	if err := o.makeRoom(entries, int64(len(body))); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), key)
+	tmp := filepath.Join(o.dir, name+".tmp")
+	if err := fsutil.WriteSynced(tmp, body); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(o.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to commit outbox entry: %w", err)
+	}
+	fsutil.SyncDir(o.dir)
+
+	return nil
+}
+
+// makeRoom drops the oldest entries until size more bytes fit under the cap
+func (o *Outbox) makeRoom(entries []string, size int64) error {
+	if o.maxSize <= 0 {
+		return nil
+	}
+	if size > o.maxSize {
+		return fmt.Errorf("report of %d bytes exceeds outbox size limit", size)
+	}
+
+	total := size
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		if info, err := os.Stat(filepath.Join(o.dir, entry)); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i := 0; total > o.maxSize && i < len(entries); i++ {
+		if err := os.Remove(filepath.Join(o.dir, entries[i])); err != nil {
+			return fmt.Errorf("failed to drop outbox entry: %w", err)
+		}
+		total -= sizes[i]
+		logger.Log.WithField("commandId", entryKey(entries[i])).Warn("Outbox full, dropped oldest undelivered report")
+	}
+
+	return nil
+}
+
+// List returns the queued entries, oldest first
+func (o *Outbox) List() ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.list()
+}
+
+func (o *Outbox) list() ([]string, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox dir: %w", err)
+	}
+
+	var entries []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			entries = append(entries, f.Name())
+		}
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// Read returns the body of an entry
+func (o *Outbox) Read(entry string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(o.dir, entry))
+}
+
+// Remove deletes a delivered entry
+func (o *Outbox) Remove(entry string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(o.dir, entry)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fsutil.SyncDir(o.dir)
+	return nil
+}
+
+// Depth returns the number of queued entries and their total size in bytes
+func (o *Outbox) Depth() (int, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.list()
+	if err != nil {
+		return 0, 0
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if info, err := os.Stat(filepath.Join(o.dir, entry)); err == nil {
+			size += info.Size()
+		}
+	}
+	return len(entries), size
+}
+
+// entryKey returns the key an entry was stored under
+func entryKey(entry string) string {
+	name := strings.TrimSuffix(entry, ".json")
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
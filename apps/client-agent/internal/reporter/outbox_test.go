@@ -0,0 +1,190 @@
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestOutbox(t *testing.T, dir string, maxSize int64) *Outbox {
+	t.Helper()
+	o, err := NewOutbox(dir, maxSize)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	return o
+}
+
+// keys returns the keys of the queued entries, oldest first
+func keys(t *testing.T, o *Outbox) []string {
+	t.Helper()
+	entries, err := o.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entryKey(entry))
+	}
+	return keys
+}
+
+func put(t *testing.T, o *Outbox, key, body string) {
+	t.Helper()
+	if err := o.Put(key, []byte(body)); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+func TestOutboxDiscardsPartialWrites(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestOutbox(t, dir, 0)
+	put(t, o, "1", `{"commandId":"1"}`)
+
+	// A crash between writing and renaming leaves only a temporary file
+	partial := filepath.Join(dir, "00000000000000000002-2.json.tmp")
+	if err := os.WriteFile(partial, []byte(`{"comm`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(t, o); strings.Join(got, ",") != "1" {
+		t.Fatalf("queued %v, want [1]", got)
+	}
+
+	// The next start removes it and keeps the committed entry
+	o = newTestOutbox(t, dir, 0)
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("partial entry not removed: %v", err)
+	}
+	entries, err := o.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List = %v, %v", entries, err)
+	}
+	if body, err := o.Read(entries[0]); err != nil || string(body) != `{"commandId":"1"}` {
+		t.Fatalf("Read = %q, %v", body, err)
+	}
+}
+
+func TestOutboxDeduplicatesByKey(t *testing.T) {
+	o := newTestOutbox(t, t.TempDir(), 0)
+	put(t, o, "1", "first")
+	put(t, o, "2", "other")
+	put(t, o, "1", "second")
+
+	if got := keys(t, o); strings.Join(got, ",") != "1,2" {
+		t.Fatalf("queued %v, want [1 2]", got)
+	}
+	entries, _ := o.List()
+	if body, _ := o.Read(entries[0]); string(body) != "first" {
+		t.Fatalf("queued body = %q, want the first report", body)
+	}
+
+	// Once delivered, the key can be queued again
+	if err := o.Remove(entries[0]); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	put(t, o, "1", "again")
+	if got := keys(t, o); strings.Join(got, ",") != "2,1" {
+		t.Fatalf("queued %v, want [2 1]", got)
+	}
+}
+
+func TestOutboxMaxSize(t *testing.T) {
+	o := newTestOutbox(t, t.TempDir(), 100)
+	body := strings.Repeat("x", 40)
+	put(t, o, "1", body)
+	put(t, o, "2", body)
+	put(t, o, "3", body)
+
+	// The oldest report is dropped to make room
+	if got := keys(t, o); strings.Join(got, ",") != "2,3" {
+		t.Fatalf("queued %v, want [2 3]", got)
+	}
+	if n, size := o.Depth(); n != 2 || size != 80 {
+		t.Fatalf("Depth = %d, %d, want 2, 80", n, size)
+	}
+
+	// A report larger than the whole outbox is refused, keeping the rest
+	if err := o.Put("4", []byte(strings.Repeat("x", 101))); err == nil {
+		t.Fatal("Put accepted a report larger than the outbox")
+	}
+	if got := keys(t, o); strings.Join(got, ",") != "2,3" {
+		t.Fatalf("queued %v, want [2 3]", got)
+	}
+}
+
+func TestHTTPReporterReplaysAfterOutage(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 3
+		received []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var report Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, report.CommandID)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	h := NewHTTPReporter(srv.URL, "secret", "lab-01", 0, newTestOutbox(t, dir, 0))
+	h.minBackoff, h.maxBackoff = time.Millisecond, 4*time.Millisecond
+
+	// Results queued while the backend is down survive a restart
+	ctx := context.Background()
+	for id := int64(1); id <= 3; id++ {
+		if err := h.Report(ctx, &types.ExecutionResult{CommandID: big.NewInt(id), Success: true}); err != nil {
+			t.Fatalf("Report: %v", err)
+		}
+	}
+	h = NewHTTPReporter(srv.URL, "secret", "lab-01", 0, newTestOutbox(t, dir, 0))
+	h.minBackoff, h.maxBackoff = time.Millisecond, 4*time.Millisecond
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go h.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := h.Depth(); n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reports not delivered after the backend recovered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != "1,2,3" {
+		t.Fatalf("delivered %v, want [1 2 3] in order", received)
+	}
+}
@@ -0,0 +1,107 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// Reporter delivers execution results to the admin side
+type Reporter interface {
+	Report(ctx context.Context, result *types.ExecutionResult) error
+}
+
+// Report is the wire format of an execution result
+type Report struct {
+	CommandID        string    `json:"commandId"`
+	BackendCommandID string    `json:"backendCommandId,omitempty"`
+	ClientID         string    `json:"clientId"`
+	State            string    `json:"state"`
+	Success          bool      `json:"success"`
+	ExitCode         int       `json:"exitCode"`
+	LimitsHit        []string  `json:"limitsHit,omitempty"`
+	Output           string    `json:"output,omitempty"`
+	OutputTruncated  bool      `json:"outputTruncated,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	ExecutedAt       time.Time `json:"executedAt"`
+	DurationMs       int64     `json:"durationMs"`
+}
+
+// NewReport converts a result to its wire format, keeping at most
+// outputLimit bytes of output
+func NewReport(clientID string, result *types.ExecutionResult, outputLimit int) *Report {
+	output := result.Output
+	truncated := false
+	if outputLimit > 0 && len(output) > outputLimit {
+		output = output[:outputLimit]
+		truncated = true
+	}
+
+	var limitsHit []string
+	for _, hit := range result.LimitsHit {
+		limitsHit = append(limitsHit, string(hit))
+	}
+
+	return &Report{
+		CommandID:        result.CommandID.String(),
+		BackendCommandID: result.BackendCommandID,
+		ClientID:         clientID,
+		State:            string(result.State),
+		Success:          result.Success,
+		ExitCode:         result.ExitCode,
+		LimitsHit:        limitsHit,
+		Output:           output,
+		OutputTruncated:  truncated,
+		Error:            result.Error,
+		ExecutedAt:       result.ExecutedAt.UTC(),
+		DurationMs:       result.Duration.Milliseconds(),
+	}
+}
+
+// Multi reports to several reporters, returning every error
+type Multi []Reporter
+
+// Report sends the result to each reporter
+func (m Multi) Report(ctx context.Context, result *types.ExecutionResult) error {
+	var errs []error
+	for _, r := range m {
+		if err := r.Report(ctx, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Depth returns the number and size of reports waiting for delivery
+func (m Multi) Depth() (int, int64) {
+	var entries int
+	var size int64
+	for _, r := range m {
+		if d, ok := r.(interface{ Depth() (int, int64) }); ok {
+			n, sz := d.Depth()
+			entries += n
+			size += sz
+		}
+	}
+	return entries, size
+}
+
+// Start launches the background delivery of reporters that have one
+func (m Multi) Start(ctx context.Context) {
+	for _, r := range m {
+		if runner, ok := r.(interface{ Run(context.Context) }); ok {
+			go runner.Run(ctx)
+		}
+	}
+}
+
+// Close releases any reporter holding a connection
+func (m Multi) Close() {
+	for _, r := range m {
+		if c, ok := r.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+}
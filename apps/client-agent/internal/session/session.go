@@ -0,0 +1,19 @@
+// Package session finds the user logged in at the machine's display
+package session
+
+import "errors"
+
+// ErrNoSession is returned when nobody is logged in at the display
+var ErrNoSession = errors.New("no desktop user is logged in")
+
+// Session is a local graphical login session
+type Session struct {
+	ID       string
+	Username string
+	UID      string
+	// Type is the display server, e.g. x11, wayland or aqua
+	Type string
+	// Env holds the variables GUI programs need to reach the session, such
+	// as DISPLAY and DBUS_SESSION_BUS_ADDRESS
+	Env []string
+}
@@ -0,0 +1,28 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Active returns the session of the user owning the console. The console
+// belongs to root while the login window is shown.
+func Active() (*Session, error) {
+	info, err := os.Stat("/dev/console")
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat console: %w", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid == 0 {
+		return nil, ErrNoSession
+	}
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up console user: %w", err)
+	}
+	return &Session{ID: "console", Username: u.Username, UID: uid, Type: "aqua"}, nil
+}
@@ -0,0 +1,237 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sessionEnv lists the variables copied from the session's own processes
+var sessionEnv = []string{"DISPLAY", "WAYLAND_DISPLAY", "DBUS_SESSION_BUS_ADDRESS", "XDG_RUNTIME_DIR", "XAUTHORITY"}
+
+// Active returns the active graphical session of the primary user. It asks
+// systemd-logind, and falls back to the runtime directories in /run/user on
+// systems without it.
+func Active() (*Session, error) {
+	s, err := fromLogind()
+	if err != nil && !errors.Is(err, ErrNoSession) {
+		// loginctl is missing or logind is not running
+		s, err = fromRunUser()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Env = discoverEnv(s)
+	return s, nil
+}
+
+// fromLogind returns the active local x11 or wayland session, preferring
+// the one on seat0
+func fromLogind() (*Session, error) {
+	out, err := exec.Command("loginctl", "list-sessions", "--no-legend").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var found *Session
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		props, err := showSession(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if props["Active"] != "yes" || props["Remote"] == "yes" {
+			continue
+		}
+		if props["Type"] != "x11" && props["Type"] != "wayland" {
+			continue
+		}
+		s := &Session{
+			ID:       fields[0],
+			Username: props["Name"],
+			UID:      props["User"],
+			Type:     props["Type"],
+		}
+		if props["Display"] != "" {
+			s.Env = append(s.Env, "DISPLAY="+props["Display"])
+		}
+		if props["Seat"] == "seat0" {
+			return s, nil
+		}
+		if found == nil {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, ErrNoSession
+	}
+	return found, nil
+}
+
+// showSession returns the logind properties of a session
+func showSession(id string) (map[string]string, error) {
+	out, err := exec.Command("loginctl", "show-session", id,
+		"-p", "Name", "-p", "User", "-p", "Type", "-p", "Active", "-p", "Remote",
+		"-p", "Seat", "-p", "Display").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session %s: %w", id, err)
+	}
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			props[key] = value
+		}
+	}
+	return props, nil
+}
+
+// fromRunUser picks the lowest non-system user with a display socket in
+// their runtime directory
+func fromRunUser() (*Session, error) {
+	dirs, err := filepath.Glob("/run/user/*")
+	if err != nil {
+		return nil, err
+	}
+	var uids []int
+	for _, dir := range dirs {
+		uid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || uid < 1000 {
+			continue
+		}
+		if sockets, _ := filepath.Glob(filepath.Join(dir, "wayland-*")); len(sockets) == 0 && !exists(filepath.Join(dir, "bus")) {
+			continue
+		}
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 {
+		return nil, ErrNoSession
+	}
+	sort.Ints(uids)
+
+	uid := strconv.Itoa(uids[0])
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up session user: %w", err)
+	}
+	s := &Session{ID: "run-user-" + uid, Username: u.Username, UID: uid, Type: "x11"}
+	if waylandSocket(filepath.Join("/run/user", uid)) != "" {
+		s.Type = "wayland"
+	}
+	return s, nil
+}
+
+// discoverEnv fills in the session variables. Values from a process running
+// in the session win; the rest are derived from well-known socket paths.
+func discoverEnv(s *Session) []string {
+	env := make(map[string]string)
+	for _, kv := range s.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env[key] = value
+	}
+
+	runtimeDir := filepath.Join("/run/user", s.UID)
+	if exists(runtimeDir) {
+		env["XDG_RUNTIME_DIR"] = runtimeDir
+		if exists(filepath.Join(runtimeDir, "bus")) {
+			env["DBUS_SESSION_BUS_ADDRESS"] = "unix:path=" + filepath.Join(runtimeDir, "bus")
+		}
+		if socket := waylandSocket(runtimeDir); socket != "" {
+			env["WAYLAND_DISPLAY"] = socket
+		}
+	}
+	if env["DISPLAY"] == "" {
+		if sockets, _ := filepath.Glob("/tmp/.X11-unix/X*"); len(sockets) > 0 {
+			sort.Strings(sockets)
+			env["DISPLAY"] = ":" + strings.TrimPrefix(filepath.Base(sockets[0]), "X")
+		}
+	}
+	for key, value := range processEnv(s) {
+		env[key] = value
+	}
+
+	var list []string
+	for _, key := range sessionEnv {
+		if env[key] != "" {
+			list = append(list, key+"="+env[key])
+		}
+	}
+	return list
+}
+
+// processEnv reads the session variables from a process of the session's
+// user, preferring one that belongs to the session itself
+func processEnv(s *Session) map[string]string {
+	uid, err := strconv.ParseUint(s.UID, 10, 32)
+	if err != nil {
+		return nil
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+
+	var best map[string]string
+	for _, proc := range procs {
+		info, err := os.Stat(proc)
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || uint64(stat.Uid) != uid {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(proc, "environ"))
+		if err != nil {
+			continue
+		}
+		vars := make(map[string]string)
+		var sessionID string
+		for _, kv := range strings.Split(string(data), "\x00") {
+			key, value, _ := strings.Cut(kv, "=")
+			if key == "XDG_SESSION_ID" {
+				sessionID = value
+			}
+			for _, k := range sessionEnv {
+				if key == k {
+					vars[key] = value
+				}
+			}
+		}
+		if vars["DISPLAY"] == "" && vars["WAYLAND_DISPLAY"] == "" {
+			continue
+		}
+		if sessionID == s.ID {
+			return vars
+		}
+		if best == nil {
+			best = vars
+		}
+	}
+	return best
+}
+
+// waylandSocket returns the name of the first Wayland socket in a runtime directory
+func waylandSocket(runtimeDir string) string {
+	sockets, _ := filepath.Glob(filepath.Join(runtimeDir, "wayland-*"))
+	sort.Strings(sockets)
+	for _, socket := range sockets {
+		if !strings.HasSuffix(socket, ".lock") {
+			return filepath.Base(socket)
+		}
+	}
+	return ""
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package session
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Active is not supported on this platform
+func Active() (*Session, error) {
+	return nil, fmt.Errorf("desktop sessions are not supported on %s", runtime.GOOS)
+}
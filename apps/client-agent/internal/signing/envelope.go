@@ -0,0 +1,68 @@
+package signing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// Open unwraps a command envelope carried in cmd.Data, if there is one. The
+// envelope and decoded payload are attached to cmd and cmd.Data is replaced by
+// the payload data. Commands with plain data are left untouched.
+func Open(cmd *types.Command) error {
+	if cmd.Envelope != nil {
+		return nil
+	}
+
+	data := strings.TrimSpace(cmd.Data)
+	if !strings.HasPrefix(data, "{") {
+		return nil
+	}
+
+	var env types.Envelope
+	if err := json.Unmarshal([]byte(data), &env); err != nil {
+		return fmt.Errorf("invalid command envelope: %w", err)
+	}
+	if env.Version != 1 {
+		return fmt.Errorf("unsupported command envelope version %d", env.Version)
+	}
+
+	raw, err := PayloadBytes(&env)
+	if err != nil {
+		return err
+	}
+
+	var payload types.Payload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return fmt.Errorf("invalid command payload: %w", err)
+	}
+
+	// The payload must describe the command it was stored with. Only the
+	// payload ID is signed, so it must be present and match on-chain.
+	if payload.CommandType != cmd.CommandType {
+		return fmt.Errorf("payload command type %d does not match command type %d", payload.CommandType, cmd.CommandType)
+	}
+	if payload.BackendCommandID == "" {
+		return fmt.Errorf("payload has no id")
+	}
+	if payload.BackendCommandID != cmd.BackendCommandID {
+		return fmt.Errorf("payload id %q does not match backend command id %q", payload.BackendCommandID, cmd.BackendCommandID)
+	}
+
+	cmd.Envelope = &env
+	cmd.Payload = &payload
+	cmd.Data = payload.Data
+	return nil
+}
+
+// PayloadBytes returns the raw payload bytes that the signature covers
+func PayloadBytes(env *types.Envelope) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope payload encoding: %w", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,179 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/phd/client-agent/internal/logger"
+)
+
+const (
+	// AlgorithmEd25519 signs the raw payload bytes with Ed25519
+	AlgorithmEd25519 = "ed25519"
+	// AlgorithmSecp256k1 signs the EIP-191 personal message hash of the
+	// payload bytes, as produced by ethers' signMessage
+	AlgorithmSecp256k1 = "secp256k1"
+)
+
+// TrustedKey is a public key allowed to sign commands
+type TrustedKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is the base64 or hex Ed25519 public key
+	PublicKey string `json:"publicKey,omitempty"`
+	// Address is the Ethereum address of a secp256k1 key
+	Address   string    `json:"address,omitempty"`
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	NotAfter  time.Time `json:"notAfter,omitempty"`
+	Revoked   bool      `json:"revoked,omitempty"`
+
+	ed25519Key ed25519.PublicKey
+	address    common.Address
+}
+
+// validAt reports whether the key may be used at t
+func (k *TrustedKey) validAt(t time.Time) bool {
+	if k.Revoked {
+		return false
+	}
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && t.After(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+func (k *TrustedKey) parse() error {
+	switch k.Algorithm {
+	case AlgorithmEd25519:
+		key, err := decodeKey(k.PublicKey)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.ID, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("key %q: ed25519 public key must be %d bytes", k.ID, ed25519.PublicKeySize)
+		}
+		k.ed25519Key = key
+	case AlgorithmSecp256k1:
+		if !common.IsHexAddress(k.Address) {
+			return fmt.Errorf("key %q: invalid address %q", k.ID, k.Address)
+		}
+		k.address = common.HexToAddress(k.Address)
+	default:
+		return fmt.Errorf("key %q: unsupported algorithm %q", k.ID, k.Algorithm)
+	}
+	return nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(strings.TrimPrefix(s, "0x")); err == nil {
+		return b, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("public key is neither hex nor base64")
+	}
+	return b, nil
+}
+
+// trustStoreFile is the on-disk format of the trust store
+type trustStoreFile struct {
+	Keys []*TrustedKey `json:"keys"`
+}
+
+// TrustStore holds the keys trusted to sign commands. The file is reloaded
+// whenever it changes, so keys can be rotated without restarting the agent.
+type TrustStore struct {
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	keys    []*TrustedKey
+}
+
+// NewTrustStore loads the trust store file
+func NewTrustStore(path string) (*TrustStore, error) {
+	ts := &TrustStore{path: path}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload re-reads the file if it changed since the last load
+func (ts *TrustStore) reload() error {
+	info, err := os.Stat(ts.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat trust store: %w", err)
+	}
+
+	ts.mu.RLock()
+	unchanged := info.ModTime().Equal(ts.modTime)
+	ts.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		return fmt.Errorf("failed to read trust store: %w", err)
+	}
+
+	var f trustStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to unmarshal trust store: %w", err)
+	}
+
+	for _, k := range f.Keys {
+		if err := k.parse(); err != nil {
+			return fmt.Errorf("invalid trust store: %w", err)
+		}
+	}
+
+	ts.mu.Lock()
+	ts.keys = f.Keys
+	ts.modTime = info.ModTime()
+	ts.mu.Unlock()
+
+	logger.Log.WithFields(map[string]interface{}{
+		"path": ts.path,
+		"keys": len(f.Keys),
+	}).Info("Loaded signing trust store")
+
+	return nil
+}
+
+// candidates returns the keys that may have produced a signature: the key
+// with the given ID, or every key of the algorithm if no ID was given
+func (ts *TrustStore) candidates(algorithm, keyID string, at time.Time) []*TrustedKey {
+	if err := ts.reload(); err != nil {
+		// Keep using the last good set of keys
+		logger.Log.WithError(err).Warn("Failed to reload trust store")
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var keys []*TrustedKey
+	for _, k := range ts.keys {
+		if k.Algorithm != algorithm || !k.validAt(at) {
+			continue
+		}
+		if keyID != "" && k.ID != keyID {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,129 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// clockSkew tolerates signer clocks slightly ahead of chain time
+const clockSkew = 5 * time.Minute
+
+// Verifier checks command signatures against a trust store
+type Verifier struct {
+	store  *TrustStore
+	maxAge time.Duration
+	replay ReplayGuard
+}
+
+// ReplayGuard remembers the signed payloads already accepted
+type ReplayGuard interface {
+	// ConsumePayload records that a key's payload was accepted for
+	// commandID and returns the command that consumed it first
+	ConsumePayload(keyID, payloadID string, commandID *big.Int) (*big.Int, error)
+}
+
+// NewVerifier creates a verifier. maxAge bounds the delay between signing a
+// payload and its command being triggered, so an old signed envelope cannot
+// be replayed in a new command.
+func NewVerifier(store *TrustStore, maxAge time.Duration) *Verifier {
+	return &Verifier{store: store, maxAge: maxAge}
+}
+
+// SetReplayGuard rejects a signed payload that was already accepted for
+// another command, even within SIGNATURE_MAX_AGE
+func (v *Verifier) SetReplayGuard(g ReplayGuard) {
+	v.replay = g
+}
+
+// Verify checks that cmd carries a payload signed by a trusted key. The
+// envelope must already have been opened with Open.
+func (v *Verifier) Verify(cmd *types.Command) error {
+	if cmd.Envelope == nil || cmd.Payload == nil {
+		return fmt.Errorf("command is not signed")
+	}
+	env := cmd.Envelope
+	if env.Signature == "" {
+		return fmt.Errorf("command envelope has no signature")
+	}
+	// The signature only covers a URL, so it must pin what the URL serves
+	if cmd.CommandType == types.CommandTypeURL && cmd.Payload.SHA256 == "" {
+		return fmt.Errorf("signed URL payload has no sha256 of the script")
+	}
+
+	signedAt := time.Unix(cmd.Payload.Timestamp, 0)
+	if cmd.Timestamp != nil {
+		triggeredAt := time.Unix(cmd.Timestamp.Int64(), 0)
+		if signedAt.After(triggeredAt.Add(clockSkew)) {
+			return fmt.Errorf("payload signed at %s, after command was triggered at %s", signedAt.UTC(), triggeredAt.UTC())
+		}
+		if v.maxAge > 0 && triggeredAt.Sub(signedAt) > v.maxAge {
+			return fmt.Errorf("payload signed at %s is older than %v when triggered", signedAt.UTC(), v.maxAge)
+		}
+	}
+
+	payload, err := PayloadBytes(env)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	keys := v.store.candidates(env.Algorithm, env.KeyID, signedAt)
+	if len(keys) == 0 {
+		return fmt.Errorf("no trusted %s key %q valid at %s", env.Algorithm, env.KeyID, signedAt.UTC())
+	}
+
+	for _, k := range keys {
+		if verifyWith(k, payload, sig) {
+			return v.consume(k, cmd)
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted key")
+}
+
+// consume rejects a payload the key already signed for another command.
+// The same command may be verified again, e.g. when it is rerun.
+func (v *Verifier) consume(k *TrustedKey, cmd *types.Command) error {
+	if v.replay == nil {
+		return nil
+	}
+	first, err := v.replay.ConsumePayload(k.ID, cmd.Payload.BackendCommandID, cmd.ID)
+	if err != nil {
+		return err
+	}
+	if first.Cmp(cmd.ID) != 0 {
+		return fmt.Errorf("payload %q signed by %s was already used by command %s", cmd.Payload.BackendCommandID, k.ID, first)
+	}
+	return nil
+}
+
+func verifyWith(k *TrustedKey, payload, sig []byte) bool {
+	switch k.Algorithm {
+	case AlgorithmEd25519:
+		return ed25519.Verify(k.ed25519Key, payload, sig)
+	case AlgorithmSecp256k1:
+		if len(sig) != crypto.SignatureLength {
+			return false
+		}
+		// Accept both 0/1 and 27/28 recovery IDs
+		sig = append([]byte(nil), sig...)
+		if sig[crypto.RecoveryIDOffset] >= 27 {
+			sig[crypto.RecoveryIDOffset] -= 27
+		}
+		pub, err := crypto.SigToPub(accounts.TextHash(payload), sig)
+		if err != nil {
+			return false
+		}
+		return crypto.PubkeyToAddress(*pub) == k.address
+	}
+	return false
+}
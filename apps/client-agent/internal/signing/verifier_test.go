@@ -0,0 +1,295 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testKeys are the signing keys behind the test trust store
+type testKeys struct {
+	ed      ed25519.PrivateKey
+	revoked ed25519.PrivateKey
+	expired ed25519.PrivateKey
+	future  ed25519.PrivateKey
+	eth     *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{}
+	for _, key := range []*ed25519.PrivateKey{&k.ed, &k.revoked, &k.expired, &k.future} {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*key = priv
+	}
+	eth, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.eth = eth
+	return k
+}
+
+// writeTrustStore writes a trust store for k and loads it
+func (k *testKeys) writeTrustStore(t *testing.T) *TrustStore {
+	t.Helper()
+	pub := func(priv ed25519.PrivateKey) string {
+		return hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+	}
+	now := time.Now()
+	f := trustStoreFile{Keys: []*TrustedKey{
+		{ID: "ed-1", Algorithm: AlgorithmEd25519, PublicKey: pub(k.ed)},
+		{ID: "ed-revoked", Algorithm: AlgorithmEd25519, PublicKey: pub(k.revoked), Revoked: true},
+		{ID: "ed-expired", Algorithm: AlgorithmEd25519, PublicKey: pub(k.expired), NotAfter: now.Add(-time.Hour)},
+		{ID: "ed-future", Algorithm: AlgorithmEd25519, PublicKey: pub(k.future), NotBefore: now.Add(time.Hour)},
+		{ID: "eth-1", Algorithm: AlgorithmSecp256k1, Address: crypto.PubkeyToAddress(k.eth.PublicKey).Hex()},
+	}}
+	data, err := json.Marshal(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "trust.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTrustStore(path)
+	if err != nil {
+		t.Fatalf("NewTrustStore: %v", err)
+	}
+	return store
+}
+
+func signEd25519(key ed25519.PrivateKey) func([]byte) []byte {
+	return func(payload []byte) []byte {
+		return ed25519.Sign(key, payload)
+	}
+}
+
+// signEIP191 signs like ethers' signMessage, optionally with a 27/28 recovery ID
+func signEIP191(key *ecdsa.PrivateKey, legacyV bool) func([]byte) []byte {
+	return func(payload []byte) []byte {
+		sig, err := crypto.Sign(accounts.TextHash(payload), key)
+		if err != nil {
+			panic(err)
+		}
+		if legacyV {
+			sig[crypto.RecoveryIDOffset] += 27
+		}
+		return sig
+	}
+}
+
+// signedCommand builds and opens a command carrying payload, signed by sign
+func signedCommand(t *testing.T, id int64, payload *types.Payload, alg, kid string, sign func([]byte) []byte, triggeredAt time.Time) *types.Command {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &types.Envelope{
+		Version:   1,
+		Payload:   base64.StdEncoding.EncodeToString(raw),
+		Algorithm: alg,
+		KeyID:     kid,
+	}
+	if sign != nil {
+		env.Signature = base64.StdEncoding.EncodeToString(sign(raw))
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &types.Command{
+		ID:               big.NewInt(id),
+		CommandType:      payload.CommandType,
+		Data:             string(data),
+		Timestamp:        big.NewInt(triggeredAt.Unix()),
+		BackendCommandID: payload.BackendCommandID,
+	}
+	if err := Open(cmd); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return cmd
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	store := keys.writeTrustStore(t)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		alg       string
+		kid       string
+		sign      func([]byte) []byte
+		signedAt  time.Time
+		urlDigest *string
+		wantErr   string
+	}{
+		{name: "ed25519", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed)},
+		{name: "ed25519 without kid", alg: AlgorithmEd25519, sign: signEd25519(keys.ed)},
+		{name: "secp256k1", alg: AlgorithmSecp256k1, kid: "eth-1", sign: signEIP191(keys.eth, false)},
+		{name: "secp256k1 with v 27/28", alg: AlgorithmSecp256k1, kid: "eth-1", sign: signEIP191(keys.eth, true)},
+		{name: "unsigned", alg: AlgorithmEd25519, kid: "ed-1", wantErr: "no signature"},
+		{name: "untrusted ed25519 key", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.revoked), wantErr: "does not match"},
+		{name: "untrusted secp256k1 key", alg: AlgorithmSecp256k1, kid: "eth-1", sign: signEd25519(keys.ed), wantErr: "does not match"},
+		{name: "wrong kid", alg: AlgorithmEd25519, kid: "eth-1", sign: signEd25519(keys.ed), wantErr: "no trusted ed25519 key"},
+		{name: "unknown kid", alg: AlgorithmEd25519, kid: "ed-2", sign: signEd25519(keys.ed), wantErr: "no trusted ed25519 key"},
+		{name: "revoked key", alg: AlgorithmEd25519, kid: "ed-revoked", sign: signEd25519(keys.revoked), wantErr: "no trusted ed25519 key"},
+		{name: "expired key", alg: AlgorithmEd25519, kid: "ed-expired", sign: signEd25519(keys.expired), wantErr: "no trusted ed25519 key"},
+		{name: "key not yet valid", alg: AlgorithmEd25519, kid: "ed-future", sign: signEd25519(keys.future), wantErr: "no trusted ed25519 key"},
+		{name: "older than max age", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed), signedAt: now.Add(-2 * time.Hour), wantErr: "older than"},
+		{name: "within clock skew", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed), signedAt: now.Add(clockSkew / 2)},
+		{name: "signed after trigger", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed), signedAt: now.Add(2 * clockSkew), wantErr: "after command was triggered"},
+		{name: "url with digest", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed), urlDigest: strPtr(strings.Repeat("ab", 32))},
+		{name: "url without digest", alg: AlgorithmEd25519, kid: "ed-1", sign: signEd25519(keys.ed), urlDigest: strPtr(""), wantErr: "no sha256"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedAt := tt.signedAt
+			if signedAt.IsZero() {
+				signedAt = now
+			}
+			payload := &types.Payload{
+				BackendCommandID: fmt.Sprintf("cmd-%d", i),
+				CommandType:      types.CommandTypeScript,
+				Data:             base64.StdEncoding.EncodeToString([]byte("echo ok\n")),
+				Timestamp:        signedAt.Unix(),
+			}
+			if tt.urlDigest != nil {
+				payload.CommandType = types.CommandTypeURL
+				payload.Data = "https://example.com/script.sh"
+				payload.SHA256 = *tt.urlDigest
+			}
+			cmd := signedCommand(t, int64(i+1), payload, tt.alg, tt.kid, tt.sign, now)
+
+			err := NewVerifier(store, time.Hour).Verify(cmd)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Verify = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// memoryGuard is a ReplayGuard that keeps consumed payloads in memory
+type memoryGuard map[string]*big.Int
+
+func (g memoryGuard) ConsumePayload(keyID, payloadID string, commandID *big.Int) (*big.Int, error) {
+	key := keyID + "\x00" + payloadID
+	if first, ok := g[key]; ok {
+		return first, nil
+	}
+	g[key] = commandID
+	return commandID, nil
+}
+
+func TestVerifyRefusesReplays(t *testing.T) {
+	keys := newTestKeys(t)
+	v := NewVerifier(keys.writeTrustStore(t), time.Hour)
+	v.SetReplayGuard(memoryGuard{})
+	now := time.Now()
+
+	payload := &types.Payload{
+		BackendCommandID: "cmd-1",
+		CommandType:      types.CommandTypeScript,
+		Data:             base64.StdEncoding.EncodeToString([]byte("echo ok\n")),
+		Timestamp:        now.Unix(),
+	}
+	sign := signEd25519(keys.ed)
+
+	if err := v.Verify(signedCommand(t, 7, payload, AlgorithmEd25519, "ed-1", sign, now)); err != nil {
+		t.Fatalf("first Verify: %v", err)
+	}
+	// Rerunning the same command is allowed
+	if err := v.Verify(signedCommand(t, 7, payload, AlgorithmEd25519, "ed-1", sign, now)); err != nil {
+		t.Fatalf("Verify of the same command: %v", err)
+	}
+	// The same envelope triggered as another command is a replay
+	err := v.Verify(signedCommand(t, 8, payload, AlgorithmEd25519, "ed-1", sign, now))
+	if err == nil || !strings.Contains(err.Error(), "already used by command 7") {
+		t.Fatalf("replayed Verify = %v, want already used error", err)
+	}
+}
+
+func TestOpenBindsPayloadToCommand(t *testing.T) {
+	payload, err := json.Marshal(&types.Payload{BackendCommandID: "cmd-1", CommandType: types.CommandTypeScript, Data: "ZWNobwo="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noID, err := json.Marshal(&types.Payload{CommandType: types.CommandTypeScript, Data: "ZWNobwo="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := func(raw []byte) string {
+		data, _ := json.Marshal(&types.Envelope{Version: 1, Payload: base64.StdEncoding.EncodeToString(raw)})
+		return string(data)
+	}
+
+	tests := []struct {
+		name      string
+		data      string
+		cmdType   types.CommandType
+		backendID string
+		wantErr   string
+	}{
+		{name: "matching", data: envelope(payload), backendID: "cmd-1"},
+		{name: "plain data", data: "ZWNobwo="},
+		{name: "other backend id", data: envelope(payload), backendID: "cmd-2", wantErr: "does not match backend command id"},
+		{name: "other type", data: envelope(payload), cmdType: types.CommandTypeURL, backendID: "cmd-1", wantErr: "does not match command type"},
+		{name: "payload without id", data: envelope(noID), wantErr: "payload has no id"},
+		{name: "unknown version", data: `{"v": 2, "payload": ""}`, wantErr: "unsupported command envelope version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &types.Command{ID: big.NewInt(1), CommandType: tt.cmdType, Data: tt.data, BackendCommandID: tt.backendID}
+			err := Open(cmd)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Open: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Open = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,244 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// commandFile is the on-disk format of a command in a DirSource directory
+type commandFile struct {
+	ID               json.Number       `json:"id"`
+	CommandType      types.CommandType `json:"commandType"`
+	Data             string            `json:"data"`
+	Timestamp        int64             `json:"timestamp"`
+	TriggeredBy      string            `json:"triggeredBy"`
+	BackendCommandID string            `json:"backendCommandId"`
+}
+
+// DirSource reads commands from JSON files in a local directory, for
+// air-gapped labs without chain access. Each *.json file holds one command;
+// the directory is rescanned every interval.
+type DirSource struct {
+	dir      string
+	interval time.Duration
+	stream   chan *types.Command
+	wake     chan struct{}
+
+	mu     sync.Mutex
+	seen   map[string]time.Time // file name -> mod time already handled
+	cancel context.CancelFunc
+}
+
+// NewDirSource creates a source reading command files from dir
+func NewDirSource(dir string, interval time.Duration) (*DirSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create command dir: %w", err)
+	}
+
+	return &DirSource{
+		dir:      dir,
+		interval: interval,
+		stream:   make(chan *types.Command),
+		wake:     make(chan struct{}, 1),
+		seen:     make(map[string]time.Time),
+	}, nil
+}
+
+// PollNow makes the running source rescan the directory immediately
+func (d *DirSource) PollNow() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start rescans the directory every interval, streaming new or changed
+// command files in ID order
+func (d *DirSource) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	d.mu.Lock()
+	d.cancel = cancel
+	d.mu.Unlock()
+	defer cancel()
+
+	logger.Log.WithFields(map[string]interface{}{
+		"dir":      d.dir,
+		"interval": d.interval,
+	}).Info("Starting directory command source")
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.scanNew(ctx); err != nil {
+			logger.Log.WithError(err).Error("Failed to scan command dir")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Log.Info("Stopping directory command source")
+			return nil
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// scanNew streams commands from files not seen at their current mod time
+func (d *DirSource) scanNew(ctx context.Context) error {
+	entries, _, err := d.load()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		d.mu.Lock()
+		handled := d.seen[e.name].Equal(e.modTime)
+		d.mu.Unlock()
+		if handled {
+			continue
+		}
+
+		select {
+		case d.stream <- e.command:
+		case <-ctx.Done():
+			return nil
+		}
+
+		d.mu.Lock()
+		d.seen[e.name] = e.modTime
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+type dirEntry struct {
+	name    string
+	modTime time.Time
+	command *types.Command
+}
+
+// load parses every command file, sorted by command ID. It also returns the
+// number of files that could not be parsed, which may still be being written.
+func (d *DirSource) load() ([]dirEntry, int, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read command dir: %w", err)
+	}
+
+	var entries []dirEntry
+	invalid := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		cmd, err := readCommandFile(filepath.Join(d.dir, f.Name()))
+		if err != nil {
+			logger.Log.WithError(err).WithField("file", f.Name()).Warn("Skipping invalid command file")
+			invalid++
+			continue
+		}
+
+		entries = append(entries, dirEntry{name: f.Name(), modTime: info.ModTime(), command: cmd})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].command.ID.Cmp(entries[j].command.ID) < 0
+	})
+	return entries, invalid, nil
+}
+
+func readCommandFile(path string) (*types.Command, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cf commandFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+	}
+
+	id, ok := new(big.Int).SetString(cf.ID.String(), 10)
+	if !ok || id.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid command id %q", cf.ID)
+	}
+
+	timestamp := cf.Timestamp
+	if timestamp == 0 {
+		if info, err := os.Stat(path); err == nil {
+			timestamp = info.ModTime().Unix()
+		}
+	}
+
+	return &types.Command{
+		ID:               id,
+		CommandType:      cf.CommandType,
+		Data:             cf.Data,
+		Timestamp:        big.NewInt(timestamp),
+		TriggeredBy:      cf.TriggeredBy,
+		BackendCommandID: cf.BackendCommandID,
+	}, nil
+}
+
+// Stop stops the scan loop
+func (d *DirSource) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// Commands streams commands from new or changed files
+func (d *DirSource) Commands() <-chan *types.Command {
+	return d.stream
+}
+
+// GetCommand returns the command with the given ID from the directory. The
+// command is only reported missing when every file parsed, since an invalid
+// file may be the command still being written.
+func (d *DirSource) GetCommand(ctx context.Context, id *big.Int) (*types.Command, error) {
+	entries, invalid, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.command.ID.Cmp(id) == 0 {
+			return e.command, nil
+		}
+	}
+	if invalid > 0 {
+		return nil, fmt.Errorf("command %s not in %s, and %d command files could not be parsed", id, d.dir, invalid)
+	}
+	return nil, fmt.Errorf("command %s in %s: %w", id, d.dir, ErrNotFound)
+}
+
+// LatestCommandID returns the highest command ID in the directory
+func (d *DirSource) LatestCommandID(ctx context.Context) (*big.Int, error) {
+	entries, _, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return big.NewInt(0), nil
+	}
+	return new(big.Int).Set(entries[len(entries)-1].command.ID), nil
+}
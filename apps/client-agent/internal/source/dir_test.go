@@ -0,0 +1,190 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestDirSource(t *testing.T) *DirSource {
+	t.Helper()
+	d, err := NewDirSource(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("NewDirSource: %v", err)
+	}
+	return d
+}
+
+func writeCommandFile(t *testing.T, d *DirSource, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(d.dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirSourcePartialFileIsNotMissing(t *testing.T) {
+	d := newTestDirSource(t)
+	ctx := context.Background()
+
+	// 4.json lands before 3.json has been written completely
+	writeCommandFile(t, d, "4.json", `{"id": 4, "commandType": 0, "data": "ZWNobyBvawo="}`)
+	writeCommandFile(t, d, "3.json", `{"id": 3, "commandType": 0, "da`)
+
+	latest, err := d.LatestCommandID(ctx)
+	if err != nil || latest.Cmp(big.NewInt(4)) != 0 {
+		t.Fatalf("LatestCommandID = %v, %v, want 4", latest, err)
+	}
+	if _, err := d.GetCommand(ctx, big.NewInt(3)); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetCommand(3) with a partial file = %v, want a retryable error", err)
+	}
+
+	writeCommandFile(t, d, "3.json", `{"id": 3, "commandType": 0, "data": "ZWNobyBvawo="}`)
+	cmd, err := d.GetCommand(ctx, big.NewInt(3))
+	if err != nil {
+		t.Fatalf("GetCommand(3): %v", err)
+	}
+	if cmd.ID.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("GetCommand(3) returned command %s", cmd.ID)
+	}
+}
+
+// receive reads n streamed command IDs
+func receive(t *testing.T, d *DirSource, n int) []int64 {
+	t.Helper()
+	var ids []int64
+	for len(ids) < n {
+		select {
+		case cmd := <-d.Commands():
+			ids = append(ids, cmd.ID.Int64())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want %d commands", ids, n)
+		}
+	}
+	return ids
+}
+
+func TestDirSourceStreamsInIDOrder(t *testing.T) {
+	d := newTestDirSource(t)
+	writeCommandFile(t, d, "10.json", `{"id": 10, "data": "ZWNobyBvawo="}`)
+	writeCommandFile(t, d, "2.json", `{"id": 2, "data": "ZWNobyBvawo="}`)
+	writeCommandFile(t, d, "backup.json", `{"id": 5, "data": "ZWNobyBvawo="}`)
+	writeCommandFile(t, d, "notes.txt", `{"id": 1}`)
+	if err := os.Mkdir(filepath.Join(d.dir, "0.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx)
+
+	// Files are ordered by the command ID inside them, not their names
+	if ids := receive(t, d, 3); ids[0] != 2 || ids[1] != 5 || ids[2] != 10 {
+		t.Fatalf("streamed %v, want [2 5 10]", ids)
+	}
+
+	// Only new and changed files are streamed again
+	writeCommandFile(t, d, "2.json", `{"id": 2, "data": "ZWNobyBhZ2Fpbgo="}`)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(d.dir, "2.json"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	writeCommandFile(t, d, "11.json", `{"id": 11, "data": "ZWNobyBvawo="}`)
+	d.PollNow()
+	if ids := receive(t, d, 2); ids[0] != 2 || ids[1] != 11 {
+		t.Fatalf("streamed %v, want [2 11]", ids)
+	}
+
+	select {
+	case cmd := <-d.Commands():
+		t.Fatalf("unchanged command %s streamed again", cmd.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDirSourceSkipsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", `echo ok`},
+		{"no id", `{"data": "ZWNobyBvawo="}`},
+		{"zero id", `{"id": 0, "data": "ZWNobyBvawo="}`},
+		{"negative id", `{"id": -3, "data": "ZWNobyBvawo="}`},
+		{"fractional id", `{"id": 3.5, "data": "ZWNobyBvawo="}`},
+		{"partial", `{"id": 9, "data": "ZWNo`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDirSource(t)
+			ctx := context.Background()
+			writeCommandFile(t, d, "1.json", `{"id": 1, "data": "ZWNobyBvawo="}`)
+			writeCommandFile(t, d, "bad.json", tt.content)
+
+			entries, invalid, err := d.load()
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if len(entries) != 1 || invalid != 1 {
+				t.Fatalf("load = %d entries, %d invalid, want 1, 1", len(entries), invalid)
+			}
+			if latest, err := d.LatestCommandID(ctx); err != nil || latest.Cmp(big.NewInt(1)) != 0 {
+				t.Fatalf("LatestCommandID = %v, %v, want 1", latest, err)
+			}
+			if _, err := d.GetCommand(ctx, big.NewInt(1)); err != nil {
+				t.Fatalf("GetCommand(1): %v", err)
+			}
+			if _, err := d.GetCommand(ctx, big.NewInt(2)); err == nil || errors.Is(err, ErrNotFound) {
+				t.Fatalf("GetCommand(2) = %v, want a retryable error", err)
+			}
+		})
+	}
+}
+
+func TestDirSourceGetCommand(t *testing.T) {
+	d := newTestDirSource(t)
+	ctx := context.Background()
+
+	if latest, err := d.LatestCommandID(ctx); err != nil || latest.Sign() != 0 {
+		t.Fatalf("LatestCommandID of an empty dir = %v, %v, want 0", latest, err)
+	}
+	if _, err := d.GetCommand(ctx, big.NewInt(1)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetCommand(1) in an empty dir = %v, want ErrNotFound", err)
+	}
+
+	writeCommandFile(t, d, "7.json", `{"id": 7, "commandType": 1, "data": "https://example.com/s.sh", "triggeredBy": "0x1111111111111111111111111111111111111111", "backendCommandId": "b-7"}`)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(d.dir, "7.json"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := d.GetCommand(ctx, big.NewInt(7))
+	if err != nil {
+		t.Fatalf("GetCommand(7): %v", err)
+	}
+	if cmd.CommandType != 1 || cmd.Data != "https://example.com/s.sh" || cmd.BackendCommandID != "b-7" ||
+		cmd.TriggeredBy != "0x1111111111111111111111111111111111111111" {
+		t.Errorf("GetCommand(7) = %+v", cmd)
+	}
+	// A file without a timestamp was triggered when it was written
+	if cmd.Timestamp.Int64() != modTime.Unix() {
+		t.Errorf("timestamp = %s, want the file's mod time %d", cmd.Timestamp, modTime.Unix())
+	}
+
+	if _, err := d.GetCommand(ctx, big.NewInt(6)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetCommand(6) = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,95 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// MemorySource is an in-memory CommandSource, mainly for tests
+type MemorySource struct {
+	mu       sync.RWMutex
+	commands map[string]*types.Command
+	latestID *big.Int
+	stream   chan *types.Command
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMemorySource creates an empty in-memory source
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		commands: make(map[string]*types.Command),
+		latestID: big.NewInt(0),
+		stream:   make(chan *types.Command),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add stores a command so it can be fetched by ID, without streaming it.
+// This simulates commands that were issued while the agent was offline.
+func (m *MemorySource) Add(cmd *types.Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.commands[cmd.ID.String()] = cmd
+	if cmd.ID.Cmp(m.latestID) > 0 {
+		m.latestID = new(big.Int).Set(cmd.ID)
+	}
+}
+
+// Push stores a command and streams it, blocking until it is received or the
+// source is stopped
+func (m *MemorySource) Push(ctx context.Context, cmd *types.Command) error {
+	m.Add(cmd)
+
+	select {
+	case m.stream <- cmd:
+		return nil
+	case <-m.done:
+		return fmt.Errorf("source stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start blocks until ctx is cancelled or Stop is called
+func (m *MemorySource) Start(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-m.done:
+	}
+	return nil
+}
+
+// Stop unblocks Start and pending Push calls
+func (m *MemorySource) Stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+}
+
+// Commands streams pushed commands
+func (m *MemorySource) Commands() <-chan *types.Command {
+	return m.stream
+}
+
+// GetCommand returns a stored command
+func (m *MemorySource) GetCommand(ctx context.Context, id *big.Int) (*types.Command, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cmd, ok := m.commands[id.String()]
+	if !ok {
+		return nil, fmt.Errorf("command %s: %w", id, ErrNotFound)
+	}
+	return cmd, nil
+}
+
+// LatestCommandID returns the highest stored command ID
+func (m *MemorySource) LatestCommandID(ctx context.Context) (*big.Int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return new(big.Int).Set(m.latestID), nil
+}
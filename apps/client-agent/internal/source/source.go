@@ -0,0 +1,45 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// ErrNotFound is returned by GetCommand for an ID the source does not have
+var ErrNotFound = errors.New("command not found")
+
+// CommandSource delivers commands to the agent. The EVM poller is the
+// production implementation; MemorySource and DirSource allow running the
+// execute pipeline without a chain.
+type CommandSource interface {
+	// Start delivers new commands on Commands until ctx is cancelled or Stop
+	// is called
+	Start(ctx context.Context) error
+	// Stop stops delivery and releases the source's resources
+	Stop()
+	// Commands streams newly observed commands
+	Commands() <-chan *types.Command
+	// GetCommand fetches a command by ID, failing with ErrNotFound if the
+	// source has no such command
+	GetCommand(ctx context.Context, id *big.Int) (*types.Command, error)
+	// LatestCommandID returns the newest command ID, or 0 if there is none
+	LatestCommandID(ctx context.Context) (*big.Int, error)
+}
+
+// AdminWatcher is implemented by sources backed by a contract with an admin
+// that can be transferred
+type AdminWatcher interface {
+	// AdminChanges streams admin transfers observed by the source
+	AdminChanges() <-chan *types.AdminChange
+	// CurrentAdmin returns the current admin address
+	CurrentAdmin(ctx context.Context) (string, error)
+}
+
+// PollTrigger is implemented by sources that check for new commands on an
+// interval and can be asked to check right away
+type PollTrigger interface {
+	PollNow()
+}
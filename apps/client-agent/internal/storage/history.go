@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/phd/client-agent/pkg/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// resultOutputLimit is the number of output bytes kept per result. The
+// digest always covers the full output.
+const resultOutputLimit = 4096
+
+// ResultRecord is an execution result kept in the history
+type ResultRecord struct {
+	CommandID        string             `json:"commandId"`
+	BackendCommandID string             `json:"backendCommandId,omitempty"`
+	CommandType      types.CommandType  `json:"commandType"`
+	ScriptName       string             `json:"scriptName,omitempty"`
+	ScriptDigest     string             `json:"scriptDigest,omitempty"`
+	State            types.CommandState `json:"state"`
+	Success          bool               `json:"success"`
+	ExitCode         int                `json:"exitCode"`
+	Attempts         int                `json:"attempts"`
+	LimitsHit        []types.LimitHit   `json:"limitsHit,omitempty"`
+	Output           string             `json:"output,omitempty"`
+	OutputTruncated  bool               `json:"outputTruncated,omitempty"`
+	OutputDigest     string             `json:"outputDigest"`
+	Error            string             `json:"error,omitempty"`
+	ExecutedAt       time.Time          `json:"executedAt"`
+	Duration         time.Duration      `json:"duration"`
+}
+
+// ResultQuery selects results from the history. Zero fields match anything.
+type ResultQuery struct {
+	Since        time.Time          `json:"since,omitempty"`
+	Until        time.Time          `json:"until,omitempty"`
+	Success      *bool              `json:"success,omitempty"`
+	State        types.CommandState `json:"state,omitempty"`
+	CommandType  *types.CommandType `json:"commandType,omitempty"`
+	ScriptName   string             `json:"scriptName,omitempty"`
+	ScriptDigest string             `json:"scriptDigest,omitempty"`
+	Limit        int                `json:"limit,omitempty"`
+}
+
+func (q *ResultQuery) matches(r *ResultRecord) bool {
+	if !q.Since.IsZero() && r.ExecutedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.ExecutedAt.Before(q.Until) {
+		return false
+	}
+	if q.Success != nil && r.Success != *q.Success {
+		return false
+	}
+	if q.State != "" && r.State != q.State {
+		return false
+	}
+	if q.CommandType != nil && r.CommandType != *q.CommandType {
+		return false
+	}
+	if q.ScriptName != "" && r.ScriptName != q.ScriptName {
+		return false
+	}
+	if q.ScriptDigest != "" && !strings.EqualFold(r.ScriptDigest, q.ScriptDigest) {
+		return false
+	}
+	return true
+}
+
+// SetRetention limits the history to results younger than maxAge and to the
+// newest maxCount results. Zero disables a limit.
+func (s *Storage) SetRetention(maxAge time.Duration, maxCount int) {
+	s.resultMaxAge = maxAge
+	s.resultMaxCount = maxCount
+}
+
+// RecordResult stores a result and marks its command executed in one
+// transaction, ending its lifecycle, and applies the retention limits
+func (s *Storage) RecordResult(result *types.ExecutionResult) error {
+	digest := sha256.Sum256([]byte(result.Output))
+	record := &ResultRecord{
+		CommandID:        result.CommandID.String(),
+		BackendCommandID: result.BackendCommandID,
+		CommandType:      result.CommandType,
+		ScriptName:       result.ScriptName,
+		ScriptDigest:     result.ScriptDigest,
+		State:            result.State,
+		LimitsHit:        result.LimitsHit,
+		Success:          result.Success,
+		ExitCode:         result.ExitCode,
+		Attempts:         result.Attempts,
+		Output:           result.Output,
+		OutputDigest:     hex.EncodeToString(digest[:]),
+		Error:            result.Error,
+		ExecutedAt:       result.ExecutedAt.UTC(),
+		Duration:         result.Duration,
+	}
+	if len(record.Output) > resultOutputLimit {
+		record.Output = record.Output[:resultOutputLimit]
+		record.OutputTruncated = true
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.put(tx, bucketResults, commandKey(result.CommandID), data); err != nil {
+			return err
+		}
+		if err := s.markExecuted(tx, result.CommandID, result.ExecutedAt); err != nil {
+			return err
+		}
+		_, err := s.prune(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record result: %w", err)
+	}
+	return nil
+}
+
+// GetResult returns the stored result of a command, or nil if there is none
+func (s *Storage) GetResult(commandID *big.Int) (*ResultRecord, error) {
+	var record *ResultRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data, err := s.get(tx, bucketResults, commandKey(commandID))
+		if data == nil || err != nil {
+			return err
+		}
+		record = &ResultRecord{}
+		return json.Unmarshal(data, record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+	return record, nil
+}
+
+// QueryResults returns the results matching q, newest command first
+func (s *Storage) QueryResults(q ResultQuery) ([]*ResultRecord, error) {
+	var records []*ResultRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketResults).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			data, err := s.sealer.open(bucketResults, k, v)
+			if err != nil {
+				return err
+			}
+			record := &ResultRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			if !q.matches(record) {
+				continue
+			}
+			records = append(records, record)
+			if q.Limit > 0 && len(records) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query results: %w", err)
+	}
+	return records, nil
+}
+
+// PruneResults applies the retention limits and returns the number of
+// results removed. Executed markers are kept so pruned commands never re-run.
+func (s *Storage) PruneResults() (int, error) {
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = s.prune(tx)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune results: %w", err)
+	}
+	return removed, nil
+}
+
+func (s *Storage) prune(tx *bolt.Tx) (int, error) {
+	if s.resultMaxAge <= 0 && s.resultMaxCount <= 0 {
+		return 0, nil
+	}
+
+	b := tx.Bucket(bucketResults)
+	cutoff := time.Now().Add(-s.resultMaxAge)
+	excess := 0
+	if s.resultMaxCount > 0 {
+		_ = b.ForEach(func(k, v []byte) error {
+			excess++
+			return nil
+		})
+		excess -= s.resultMaxCount
+	}
+
+	// Keys are copied out first, deleting under a cursor skips entries
+	var expired [][]byte
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if excess > 0 {
+			expired = append(expired, append([]byte(nil), k...))
+			excess--
+			continue
+		}
+		if s.resultMaxAge <= 0 {
+			break
+		}
+		var record ResultRecord
+		data, err := s.sealer.open(bucketResults, k, v)
+		if err != nil || json.Unmarshal(data, &record) != nil || record.ExecutedAt.Before(cutoff) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+	}
+
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
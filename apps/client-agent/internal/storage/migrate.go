@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/phd/client-agent/internal/fsutil"
+	"github.com/phd/client-agent/internal/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// legacyFileName is the JSON file used before the embedded database
+const legacyFileName = "executed.json"
+
+// legacyDirName is the per-user state directory used before DATA_DIR
+const legacyDirName = ".phd-client-agent"
+
+// legacyEntries are the state files moved out of a legacy directory
+var legacyEntries = []string{
+	dbFileName,
+	legacyFileName,
+	legacyFileName + ".migrated",
+	legacyFileName + ".corrupt",
+	"outbox",
+}
+
+// legacyDirs returns the per-user state directories older versions may have
+// used. The agent re-executes itself through sudo, so state may sit in the
+// invoking user's home as well as in root's.
+func legacyDirs() []string {
+	var homes []string
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		if u, err := user.Lookup(sudoUser); err == nil {
+			homes = append(homes, u.HomeDir)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		homes = append(homes, home)
+	}
+
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, home := range homes {
+		dir := filepath.Join(home, legacyDirName)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// moveLegacyDir moves the state of the first legacy directory holding any
+// into storageDir, unless storageDir already has state of its own. Other
+// legacy directories are left alone and reported.
+func moveLegacyDir(storageDir string) error {
+	if exists(filepath.Join(storageDir, dbFileName)) || exists(filepath.Join(storageDir, legacyFileName)) {
+		return nil
+	}
+
+	moved := ""
+	for _, dir := range legacyDirs() {
+		if !exists(filepath.Join(dir, dbFileName)) && !exists(filepath.Join(dir, legacyFileName)) {
+			continue
+		}
+		if same, _ := sameDir(dir, storageDir); same {
+			continue
+		}
+		if moved != "" {
+			logger.Log.WithFields(map[string]interface{}{
+				"dir":      dir,
+				"migrated": moved,
+			}).Warn("Found additional legacy state, leaving it in place")
+			continue
+		}
+
+		for _, name := range legacyEntries {
+			from := filepath.Join(dir, name)
+			if !exists(from) {
+				continue
+			}
+			if err := moveEntry(from, filepath.Join(storageDir, name)); err != nil {
+				return fmt.Errorf("failed to move legacy state %s: %w", from, err)
+			}
+		}
+		moved = dir
+
+		logger.Log.WithFields(map[string]interface{}{
+			"from": dir,
+			"to":   storageDir,
+		}).Info("Moved state from legacy location")
+	}
+
+	return nil
+}
+
+// moveEntry renames a file or directory, copying it when the destination is
+// on another filesystem
+func moveEntry(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	if err := copyEntry(from, to); err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func copyEntry(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if err := os.MkdirAll(to, 0700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(from)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyEntry(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteSynced(to, data)
+}
+
+func sameDir(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// legacyData is the layout of executed.json
+type legacyData struct {
+	ExecutedCmds  []string `json:"executed_commands"`
+	LastCommandID string   `json:"last_command_id"`
+	LastBlock     uint64   `json:"last_block,omitempty"`
+	LastBlockHash string   `json:"last_block_hash,omitempty"`
+	PauseReason   string   `json:"pause_reason,omitempty"`
+}
+
+// migrateLegacy imports executed.json in a single transaction and renames
+// it, so the import happens once. A corrupt file is set aside instead of
+// blocking startup. It reports whether anything was imported.
+func (s *Storage) migrateLegacy(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read legacy storage: %w", err)
+	}
+
+	var ld legacyData
+	if err := json.Unmarshal(data, &ld); err != nil {
+		logger.Log.WithError(err).WithField("file", path).Error("Legacy storage is corrupt, setting it aside")
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return false, fmt.Errorf("failed to set aside corrupt legacy storage: %w", err)
+		}
+		return false, nil
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		// Legacy storage did not record execution times
+		at := time.Unix(0, 0)
+		for _, id := range ld.ExecutedCmds {
+			commandID, ok := new(big.Int).SetString(id, 10)
+			if !ok {
+				continue
+			}
+			if err := s.markExecuted(tx, commandID, at); err != nil {
+				return err
+			}
+		}
+
+		if last, ok := new(big.Int).SetString(ld.LastCommandID, 10); ok {
+			if err := s.markLastCommandID(tx, last); err != nil {
+				return err
+			}
+			// Legacy reconciliation started above the last command ID
+			if err := s.raiseWatermark(tx, last); err != nil {
+				return err
+			}
+		}
+
+		if ld.LastBlock > 0 {
+			if err := s.setLastBlock(tx, ld.LastBlock, ld.LastBlockHash); err != nil {
+				return err
+			}
+		}
+
+		if ld.PauseReason != "" {
+			return s.put(tx, bucketMeta, keyPauseReason, []byte(ld.PauseReason))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to migrate legacy storage: %w", err)
+	}
+
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return false, fmt.Errorf("failed to rename legacy storage: %w", err)
+	}
+
+	logger.Log.WithFields(map[string]interface{}{
+		"file":     path,
+		"executed": len(ld.ExecutedCmds),
+	}).Info("Migrated legacy storage")
+
+	return true, nil
+}
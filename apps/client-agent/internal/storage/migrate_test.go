@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// noLegacyHome points the per-user legacy location at an empty directory,
+// so tests never pick up state from the machine running them
+func noLegacyHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SUDO_USER", "")
+	return home
+}
+
+func writeFixture(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// legacyJSON is an executed.json as written before the embedded database
+const legacyJSON = `{
+  "executed_commands": ["1", "2", "5", "not-an-id"],
+  "last_command_id": "5",
+  "last_block": 100,
+  "last_block_hash": "0xabc",
+  "pause_reason": "maintenance"
+}`
+
+func TestMigrateLegacyJSON(t *testing.T) {
+	noLegacyHome(t)
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, legacyFileName)
+	writeFixture(t, legacy, legacyJSON)
+
+	s := openTestStorage(t, dir)
+	if s.IsFirstRun() {
+		t.Error("migrated storage reported as a first run")
+	}
+	for id, want := range map[int64]bool{1: true, 2: true, 3: false, 5: true} {
+		if got := s.IsExecuted(big.NewInt(id)); got != want {
+			t.Errorf("IsExecuted(%d) = %v, want %v", id, got, want)
+		}
+	}
+	if got := s.GetLastCommandID(); got.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("last command ID = %s, want 5", got)
+	}
+	// Legacy reconciliation never went below the last command ID
+	if got := s.ExecutedWatermark(); got.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("watermark = %s, want 5", got)
+	}
+	if block, hash := s.GetLastBlock(); block != 100 || hash != "0xabc" {
+		t.Errorf("checkpoint = %d %s, want 100 0xabc", block, hash)
+	}
+	if reason := s.PauseReason(); reason != "maintenance" {
+		t.Errorf("PauseReason = %q, want maintenance", reason)
+	}
+
+	// The file is imported once
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("legacy file still in place: %v", err)
+	}
+	if _, err := os.Stat(legacy + ".migrated"); err != nil {
+		t.Fatalf("legacy file not kept as .migrated: %v", err)
+	}
+	s.Close()
+	s = openTestStorage(t, dir)
+	if s.IsFirstRun() || !s.IsExecuted(big.NewInt(5)) {
+		t.Fatal("migrated state lost on reopen")
+	}
+}
+
+func TestMigrateSetsAsideCorruptLegacyFile(t *testing.T) {
+	noLegacyHome(t)
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, legacyFileName)
+	writeFixture(t, legacy, `{"executed_commands": ["1",`)
+
+	s := openTestStorage(t, dir)
+
+	// Nothing is replayed from a file that could not be read
+	if !s.IsFirstRun() {
+		t.Error("corrupt legacy state not treated as a first run")
+	}
+	if s.IsExecuted(big.NewInt(1)) {
+		t.Error("command from a corrupt file marked executed")
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("corrupt file still in place: %v", err)
+	}
+	data, err := os.ReadFile(legacy + ".corrupt")
+	if err != nil || string(data) != `{"executed_commands": ["1",` {
+		t.Fatalf("corrupt file not kept: %q, %v", data, err)
+	}
+}
+
+func TestMigrateMovesLegacyDir(t *testing.T) {
+	home := noLegacyHome(t)
+	writeFixture(t, filepath.Join(home, legacyDirName, legacyFileName), legacyJSON)
+	writeFixture(t, filepath.Join(home, legacyDirName, "outbox", "1.json"), `{}`)
+
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	if !s.IsExecuted(big.NewInt(5)) {
+		t.Error("state in the legacy directory not migrated")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outbox", "1.json")); err != nil {
+		t.Errorf("outbox not moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, legacyDirName, legacyFileName)); !os.IsNotExist(err) {
+		t.Errorf("legacy file left behind: %v", err)
+	}
+}
+
+func TestResealSchema1(t *testing.T) {
+	noLegacyHome(t)
+	dir := t.TempDir()
+
+	// A schema 1 database stored every value in plaintext
+	db, err := bolt.Open(filepath.Join(dir, dbFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := map[string]map[string][]byte{
+			string(bucketExecuted): {
+				string(commandKey(big.NewInt(1))): encodeUint64(1),
+				string(commandKey(big.NewInt(2))): encodeUint64(2),
+			},
+			string(bucketCheckpoints): {
+				string(keyLastBlock):     encodeUint64(100),
+				string(keyLastBlockHash): []byte("0xabc"),
+			},
+			string(bucketMeta): {
+				string(keyLastCommandID): []byte("2"),
+				string(keySchemaVersion): encodeUint64(schemaPlaintext),
+			},
+		}
+		for name, pairs := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range pairs {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestStorage(t, dir)
+	if reason := s.PauseReason(); reason != "" {
+		t.Fatalf("resealed storage paused: %q", reason)
+	}
+	if !s.IsExecuted(big.NewInt(1)) || !s.IsExecuted(big.NewInt(2)) {
+		t.Error("executed commands lost")
+	}
+	if got := s.ExecutedWatermark(); got.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("watermark = %s, want 2", got)
+	}
+	if block, hash := s.GetLastBlock(); block != 100 || hash != "0xabc" {
+		t.Errorf("checkpoint = %d %s, want 100 0xabc", block, hash)
+	}
+
+	// Values are no longer readable on disk
+	raw(t, s, func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketMeta).Get(keyLastCommandID); bytes.Equal(v, []byte("2")) {
+			t.Error("last command ID still stored in plaintext")
+		}
+		if v := tx.Bucket(bucketCheckpoints).Get(keyLastBlockHash); bytes.Contains(v, []byte("0xabc")) {
+			t.Error("checkpoint hash still stored in plaintext")
+		}
+		return nil
+	})
+
+	// The resealed state passes the integrity check after a restart
+	s.Close()
+	s = openTestStorage(t, dir)
+	if err := s.CheckIntegrity(); err != nil {
+		t.Fatalf("CheckIntegrity: %v", err)
+	}
+	if reason := s.PauseReason(); reason != "" {
+		t.Fatalf("resealed storage paused after reopen: %q", reason)
+	}
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ConsumePayload records that a signed payload was accepted for commandID
+// and returns the command that consumed it first. Entries are keyed by a MAC
+// of the key and payload IDs, so the IDs are not stored in clear.
+func (s *Storage) ConsumePayload(keyID, payloadID string, commandID *big.Int) (*big.Int, error) {
+	key := s.sealer.tag([]byte("payload\x00" + keyID + "\x00" + payloadID))
+	first := new(big.Int).Set(commandID)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		v, err := s.get(tx, bucketPayloads, key)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			if _, ok := first.SetString(string(v), 10); !ok {
+				return fmt.Errorf("invalid command ID %q", v)
+			}
+			return nil
+		}
+		return s.put(tx, bucketPayloads, key, []byte(commandID.String()))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record signed payload: %w", err)
+	}
+	return first, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// keySize is the length of the state encryption key
+const keySize = 32
+
+// sha256Size is the length of MACs and the executed digest
+const sha256Size = sha256.Size
+
+// errTampered reports a value that fails authentication
+var errTampered = errors.New("stored value failed authentication")
+
+// sealer encrypts stored values with AES-256-GCM. The bucket and key are
+// bound as additional data, so a value moved to another key fails to open.
+type sealer struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// newSealer derives the encryption and integrity keys from the state key
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("state key must be %d bytes, got %d", keySize, len(key))
+	}
+
+	block, err := aes.NewCipher(derive(key, "phd-client-agent state encryption"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return &sealer{
+		aead:   aead,
+		macKey: derive(key, "phd-client-agent state integrity"),
+	}, nil
+}
+
+// seal returns nonce || ciphertext
+func (c *sealer) seal(bucket, key, value []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("failed to read random nonce: %v", err))
+	}
+	return c.aead.Seal(nonce, nonce, value, additionalData(bucket, key))
+}
+
+func (c *sealer) open(bucket, key, sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errTampered
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	value, err := c.aead.Open(nil, nonce, ciphertext, additionalData(bucket, key))
+	if err != nil {
+		return nil, errTampered
+	}
+	return value, nil
+}
+
+// tag returns the MAC of a key. The executed set is guarded by the XOR of
+// the tags of its keys, so adding or removing any entry changes the digest.
+func (c *sealer) tag(key []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func additionalData(bucket, key []byte) []byte {
+	ad := make([]byte, 0, len(bucket)+1+len(key))
+	ad = append(ad, bucket...)
+	ad = append(ad, 0)
+	return append(ad, key...)
+}
+
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/phd/client-agent/pkg/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateEntry is the lifecycle state of a command still in flight
+type StateEntry struct {
+	CommandID *big.Int           `json:"-"`
+	State     types.CommandState `json:"state"`
+	UpdatedAt time.Time          `json:"updatedAt"`
+}
+
+// SetState persists the state a command is about to enter. Terminal states
+// are recorded by RecordResult.
+func (s *Storage) SetState(commandID *big.Int, state types.CommandState) error {
+	data, err := json.Marshal(&StateEntry{State: state, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal command state: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, bucketStates, commandKey(commandID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save command state: %w", err)
+	}
+	return nil
+}
+
+// GetState returns the current state of a command, or "" if it was never
+// received or its result has been pruned
+func (s *Storage) GetState(commandID *big.Int) (types.CommandState, error) {
+	var state types.CommandState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := commandKey(commandID)
+		data, err := s.get(tx, bucketStates, key)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			var entry StateEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			state = entry.State
+			return nil
+		}
+		data, err = s.get(tx, bucketResults, key)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			var record ResultRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			state = record.State
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read command state: %w", err)
+	}
+	return state, nil
+}
+
+// InFlight returns the commands that entered a state but never finished,
+// oldest command first
+func (s *Storage) InFlight() ([]*StateEntry, error) {
+	var entries []*StateEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketStates).ForEach(func(k, v []byte) error {
+			data, err := s.sealer.open(bucketStates, k, v)
+			if err != nil {
+				return err
+			}
+			entry := &StateEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				return err
+			}
+			entry.CommandID = new(big.Int).SetBytes(k)
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command states: %w", err)
+	}
+	return entries, nil
+}
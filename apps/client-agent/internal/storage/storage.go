@@ -1,138 +1,615 @@
 package storage
 
 import (
-	"encoding/json"
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
-	"sync"
+	"time"
+
+	"github.com/phd/client-agent/internal/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names. Every change is committed in a bbolt transaction, so a
+// crash or power loss leaves the previous state intact.
+var (
+	bucketExecuted    = []byte("executed")
+	bucketResults     = []byte("results")
+	bucketStates      = []byte("states")
+	bucketCheckpoints = []byte("checkpoints")
+	bucketMeta        = []byte("meta")
+	// bucketPayloads holds the signed payloads already accepted
+	bucketPayloads = []byte("payloads")
+)
+
+// Keys in the checkpoints and meta buckets
+var (
+	keyLastBlock      = []byte("last_block")
+	keyLastBlockHash  = []byte("last_block_hash")
+	keyLastCommandID  = []byte("last_command_id")
+	keyWatermark      = []byte("executed_watermark")
+	keyPauseReason    = []byte("pause_reason")
+	keyExecutedDigest = []byte("executed_digest")
+	keyKeyCheck       = []byte("key_check")
+	keySchemaVersion  = []byte("schema_version")
 )
 
+// Schema versions. Version 1 stored plaintext values; from version 2 every
+// value except the schema version is sealed. From version 3 the pause flag is
+// always present, so deleting it cannot lift a pause.
+const (
+	schemaPlaintext = 1
+	schemaSealed    = 2
+	schemaVersion   = 3
+)
+
+// dbFileName is the state database inside the storage directory
+const dbFileName = "state.db"
+
+// IntegrityPauseReason is the pause set when the stored state was modified
+// outside the agent
+const IntegrityPauseReason = "state integrity check failed"
+
 type Storage struct {
-	filePath       string
-	executedCmds   map[string]bool
-	lastCommandID  *big.Int
+	dir            string
+	db             *bolt.DB
+	sealer         *sealer
 	isFirstRun     bool
-	mu             sync.RWMutex
+	resultMaxAge   time.Duration
+	resultMaxCount int
 }
 
-type storageData struct {
-	ExecutedCmds  []string `json:"executed_commands"`
-	LastCommandID string   `json:"last_command_id"`
-}
-
-func NewStorage() (*Storage, error) {
-	homeDir, err := os.UserHomeDir()
+// NewStorage opens the state database in storageDir, encrypted with key,
+// moving in state left in the per-user location used by older versions
+func NewStorage(storageDir string, key []byte) (*Storage, error) {
+	sealer, err := newSealer(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home dir: %w", err)
+		return nil, err
 	}
 
-	storageDir := filepath.Join(homeDir, ".phd-client-agent")
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
+	if err := os.MkdirAll(storageDir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create storage dir: %w", err)
 	}
 
-	filePath := filepath.Join(storageDir, "executed.json")
+	dbPath := filepath.Join(storageDir, dbFileName)
+	if err := moveLegacyDir(storageDir); err != nil {
+		return nil, err
+	}
+	legacyPath := filepath.Join(storageDir, legacyFileName)
+
+	// First run means neither the database nor a legacy file exists
+	_, dbErr := os.Stat(dbPath)
+	_, legacyErr := os.Stat(legacyPath)
+	isFirstRun := os.IsNotExist(dbErr) && os.IsNotExist(legacyErr)
 
-	// Check if this is first run (storage file doesn't exist)
-	_, err = os.Stat(filePath)
-	isFirstRun := os.IsNotExist(err)
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
 
 	s := &Storage{
-		filePath:      filePath,
-		executedCmds:  make(map[string]bool),
-		lastCommandID: big.NewInt(0),
-		isFirstRun:    isFirstRun,
+		dir:        storageDir,
+		db:         db,
+		sealer:     sealer,
+		isFirstRun: isFirstRun,
 	}
 
-	if err := s.load(); err != nil {
+	if err := s.init(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
+	if err := s.CheckIntegrity(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := s.initWatermark(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	migrated, err := s.migrateLegacy(legacyPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !migrated && os.IsNotExist(dbErr) && !os.IsNotExist(legacyErr) {
+		// The legacy file existed but was unreadable; behave like a first
+		// run rather than replaying every command ever triggered
+		s.isFirstRun = true
+	}
+
 	return s, nil
 }
 
-func (s *Storage) load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// init creates the buckets and brings the schema up to date
+func (s *Storage) init() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketExecuted, bucketResults, bucketStates, bucketCheckpoints, bucketMeta, bucketPayloads} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
 
-	if _, err := os.Stat(s.filePath); os.IsNotExist(err) {
-		return nil
-	}
+		meta := tx.Bucket(bucketMeta)
+		version := uint64(0)
+		if v := meta.Get(keySchemaVersion); len(v) == 8 {
+			version = binary.BigEndian.Uint64(v)
+		}
 
-	data, err := os.ReadFile(s.filePath)
+		switch version {
+		case 0:
+			// A new database; the empty executed set has a zero digest
+			if err := s.put(tx, bucketMeta, keyExecutedDigest, make([]byte, sha256Size)); err != nil {
+				return err
+			}
+		case schemaPlaintext:
+			if err := s.sealPlaintext(tx); err != nil {
+				return err
+			}
+			logger.Log.Info("Encrypted existing storage")
+		case schemaSealed, schemaVersion:
+			// A different key is a configuration error, not tampering
+			if _, err := s.get(tx, bucketMeta, keyKeyCheck); err != nil {
+				return fmt.Errorf("state key does not match the storage in %s", s.dir)
+			}
+			if version == schemaVersion {
+				return nil
+			}
+		default:
+			return fmt.Errorf("unsupported storage schema version %d", version)
+		}
+		if version < schemaSealed {
+			if err := s.put(tx, bucketMeta, keyKeyCheck, []byte(dbFileName)); err != nil {
+				return err
+			}
+		}
+		// Older schemas deleted the pause flag to resume
+		if meta.Get(keyPauseReason) == nil {
+			if err := s.put(tx, bucketMeta, keyPauseReason, nil); err != nil {
+				return err
+			}
+		}
+		return meta.Put(keySchemaVersion, encodeUint64(schemaVersion))
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read storage: %w", err)
+		return fmt.Errorf("failed to initialize storage: %w", err)
 	}
+	return nil
+}
+
+// sealPlaintext encrypts every value of a schema 1 database in place
+func (s *Storage) sealPlaintext(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bucketExecuted, bucketResults, bucketStates, bucketCheckpoints, bucketMeta} {
+		b := tx.Bucket(name)
+
+		// Pairs are copied out first, a bucket can't change while iterated
+		var keys, values [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(name, bucketMeta) && bytes.Equal(k, keySchemaVersion) {
+				return nil
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-	var sd storageData
-	if err := json.Unmarshal(data, &sd); err != nil {
-		return fmt.Errorf("failed to unmarshal storage: %w", err)
+		for i := range keys {
+			if err := s.put(tx, name, keys[i], values[i]); err != nil {
+				return err
+			}
+		}
 	}
 
-	for _, cmdID := range sd.ExecutedCmds {
-		s.executedCmds[cmdID] = true
+	digest, err := s.executedDigest(tx)
+	if err != nil {
+		return err
 	}
+	return s.put(tx, bucketMeta, keyExecutedDigest, digest)
+}
 
-	if sd.LastCommandID != "" {
-		s.lastCommandID = new(big.Int)
-		s.lastCommandID.SetString(sd.LastCommandID, 10)
+// CheckIntegrity verifies every executed entry and the digest of the
+// executed set. A mismatch means entries were added, removed or altered
+// outside the agent: it is audited and execution is paused until an
+// operator resumes it. It runs on open and before every reconciliation.
+func (s *Storage) CheckIntegrity() error {
+	var problem string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		problem = s.integrityProblem(tx)
+		return nil
+	})
+	if err == nil && problem != "" {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			// Drop forged entries and reseal the rest, so the finding is
+			// reported once
+			if err := s.dropUnauthenticated(tx); err != nil {
+				return err
+			}
+			digest, err := s.executedDigest(tx)
+			if err != nil {
+				return err
+			}
+			if err := s.put(tx, bucketMeta, keyExecutedDigest, digest); err != nil {
+				return err
+			}
+			return s.put(tx, bucketMeta, keyPauseReason, []byte(IntegrityPauseReason))
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check storage integrity: %w", err)
 	}
 
+	if problem != "" {
+		logger.Audit("state_tampered", map[string]interface{}{
+			"dir":    s.dir,
+			"reason": problem,
+		})
+		logger.Log.WithField("reason", problem).Error("Storage was modified outside the agent, pausing execution")
+	}
 	return nil
 }
 
-func (s *Storage) save() error {
-	executedList := make([]string, 0, len(s.executedCmds))
-	for cmdID := range s.executedCmds {
-		executedList = append(executedList, cmdID)
+// integrityProblem describes how the executed set differs from its digest,
+// or returns "" if it is intact
+func (s *Storage) integrityProblem(tx *bolt.Tx) string {
+	digest, err := s.executedDigest(tx)
+	if err != nil {
+		return err.Error()
+	}
+	stored, err := s.get(tx, bucketMeta, keyExecutedDigest)
+	if err != nil {
+		return err.Error()
 	}
+	if !bytes.Equal(stored, digest) {
+		return "executed commands were added or removed"
+	}
+	return ""
+}
 
-	sd := storageData{
-		ExecutedCmds:  executedList,
-		LastCommandID: s.lastCommandID.String(),
+// dropUnauthenticated deletes executed entries that fail to open. They were
+// not written by the agent, so they must not count as executed.
+func (s *Storage) dropUnauthenticated(tx *bolt.Tx) error {
+	b := tx.Bucket(bucketExecuted)
+	var forged [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if _, err := s.sealer.open(bucketExecuted, k, v); err != nil {
+			forged = append(forged, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	for _, k := range forged {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	data, err := json.MarshalIndent(sd, "", "  ")
+// executedDigest recomputes the digest of the executed set, authenticating
+// every entry. Entries that fail to open are left out of the digest.
+func (s *Storage) executedDigest(tx *bolt.Tx) ([]byte, error) {
+	digest := make([]byte, sha256Size)
+	var bad int
+	err := tx.Bucket(bucketExecuted).ForEach(func(k, v []byte) error {
+		if _, err := s.sealer.open(bucketExecuted, k, v); err != nil {
+			bad++
+			return nil
+		}
+		xorInto(digest, s.sealer.tag(k))
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal storage: %w", err)
+		return nil, err
+	}
+	if bad > 0 {
+		return digest, fmt.Errorf("%d executed entries failed authentication", bad)
 	}
+	return digest, nil
+}
+
+// put seals and stores a value
+func (s *Storage) put(tx *bolt.Tx, bucket, key, value []byte) error {
+	return tx.Bucket(bucket).Put(key, s.sealer.seal(bucket, key, value))
+}
 
-	if err := os.WriteFile(s.filePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write storage: %w", err)
+// get returns an opened value, or nil if the key is absent
+func (s *Storage) get(tx *bolt.Tx, bucket, key []byte) ([]byte, error) {
+	sealed := tx.Bucket(bucket).Get(key)
+	if sealed == nil {
+		return nil, nil
+	}
+	value, err := s.sealer.open(bucket, key, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, err)
 	}
+	return value, nil
+}
 
-	return nil
+// Close releases the database
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Dir returns the directory holding the storage file
+func (s *Storage) Dir() string {
+	return s.dir
 }
 
 func (s *Storage) IsExecuted(commandID *big.Int) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.executedCmds[commandID.String()]
+	executed := false
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		executed = tx.Bucket(bucketExecuted).Get(commandKey(commandID)) != nil
+		return nil
+	})
+	return executed
 }
 
 func (s *Storage) MarkExecuted(commandID *big.Int) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.markExecuted(tx, commandID, time.Now())
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark command executed: %w", err)
+	}
+	return nil
+}
 
-	s.executedCmds[commandID.String()] = true
+// markExecuted records a command, updating the executed digest, and
+// advances the last command ID
+func (s *Storage) markExecuted(tx *bolt.Tx, commandID *big.Int, at time.Time) error {
+	key := commandKey(commandID)
+	if tx.Bucket(bucketExecuted).Get(key) == nil {
+		digest, err := s.get(tx, bucketMeta, keyExecutedDigest)
+		if err != nil {
+			return err
+		}
+		if len(digest) != sha256Size {
+			digest = make([]byte, sha256Size)
+		}
+		xorInto(digest, s.sealer.tag(key))
+		if err := s.put(tx, bucketMeta, keyExecutedDigest, digest); err != nil {
+			return err
+		}
+	}
 
-	if commandID.Cmp(s.lastCommandID) > 0 {
-		s.lastCommandID = commandID
+	if err := s.put(tx, bucketExecuted, key, encodeUint64(uint64(at.UnixNano()))); err != nil {
+		return err
+	}
+	// Only commands still in flight are tracked in the states bucket
+	if err := tx.Bucket(bucketStates).Delete(key); err != nil {
+		return err
+	}
+	if err := s.raiseWatermark(tx, nil); err != nil {
+		return err
 	}
+	return s.markLastCommandID(tx, commandID)
+}
+
+// MarkExecutedThrough marks a command executed and treats every lower ID as
+// handled, so reconciliation never revisits them
+func (s *Storage) MarkExecutedThrough(commandID *big.Int) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.markExecuted(tx, commandID, time.Now()); err != nil {
+			return err
+		}
+		return s.raiseWatermark(tx, commandID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark command executed: %w", err)
+	}
+	return nil
+}
 
-	return s.save()
+// initWatermark sets the watermark of databases written before it existed
+// to the last command ID, which reconciliation used to start from
+func (s *Storage) initWatermark() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketMeta).Get(keyWatermark) != nil {
+			return nil
+		}
+		last, err := s.get(tx, bucketMeta, keyLastCommandID)
+		if err != nil {
+			return err
+		}
+		if last == nil {
+			last = []byte("0")
+		}
+		if err := s.put(tx, bucketMeta, keyWatermark, last); err != nil {
+			return err
+		}
+		return s.raiseWatermark(tx, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize executed watermark: %w", err)
+	}
+	return nil
+}
+
+// raiseWatermark moves the watermark up to floor, if given, then past every
+// executed ID directly above it
+func (s *Storage) raiseWatermark(tx *bolt.Tx, floor *big.Int) error {
+	v, err := s.get(tx, bucketMeta, keyWatermark)
+	if err != nil {
+		return err
+	}
+	mark := new(big.Int)
+	if v != nil {
+		mark.SetString(string(v), 10)
+	}
+	start := new(big.Int).Set(mark)
+	if floor != nil && floor.Cmp(mark) > 0 {
+		mark.Set(floor)
+	}
+
+	executed := tx.Bucket(bucketExecuted)
+	next := new(big.Int).Add(mark, big.NewInt(1))
+	for executed.Get(commandKey(next)) != nil {
+		mark.Set(next)
+		next.Add(next, big.NewInt(1))
+	}
+
+	if mark.Cmp(start) == 0 && v != nil {
+		return nil
+	}
+	return s.put(tx, bucketMeta, keyWatermark, []byte(mark.String()))
+}
+
+// ExecutedWatermark returns the highest command ID at or below which every
+// command has been handled. Reconciliation resumes above it, so a command
+// that failed to process is retried even after later ones ran.
+func (s *Storage) ExecutedWatermark() *big.Int {
+	mark := big.NewInt(0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.get(tx, bucketMeta, keyWatermark)
+		if v != nil {
+			mark.SetString(string(v), 10)
+		}
+		return err
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("Failed to read executed watermark")
+	}
+	return mark
+}
+
+// markLastCommandID advances the last command ID without marking it executed
+func (s *Storage) markLastCommandID(tx *bolt.Tx, commandID *big.Int) error {
+	v, err := s.get(tx, bucketMeta, keyLastCommandID)
+	if err != nil {
+		return err
+	}
+	last := new(big.Int)
+	if v != nil {
+		last.SetString(string(v), 10)
+	}
+	if commandID.Cmp(last) > 0 {
+		return s.put(tx, bucketMeta, keyLastCommandID, []byte(commandID.String()))
+	}
+	return nil
 }
 
 func (s *Storage) GetLastCommandID() *big.Int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return new(big.Int).Set(s.lastCommandID)
+	last := big.NewInt(0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.get(tx, bucketMeta, keyLastCommandID)
+		if v != nil {
+			last.SetString(string(v), 10)
+		}
+		return err
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("Failed to read last command ID")
+	}
+	return last
 }
 
 func (s *Storage) IsFirstRun() bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
 	return s.isFirstRun
 }
+
+// GetLastBlock returns the last fully processed block and its hash, or 0 if
+// none was recorded
+func (s *Storage) GetLastBlock() (uint64, string) {
+	var block uint64
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.get(tx, bucketCheckpoints, keyLastBlock)
+		if err != nil {
+			return err
+		}
+		if len(v) == 8 {
+			block = binary.BigEndian.Uint64(v)
+		}
+		h, err := s.get(tx, bucketCheckpoints, keyLastBlockHash)
+		hash = string(h)
+		return err
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("Failed to read checkpoint")
+		return 0, ""
+	}
+	return block, hash
+}
+
+// SetLastBlock persists the last fully processed block and its hash
+func (s *Storage) SetLastBlock(block uint64, hash string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.setLastBlock(tx, block, hash)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) setLastBlock(tx *bolt.Tx, block uint64, hash string) error {
+	if err := s.put(tx, bucketCheckpoints, keyLastBlock, encodeUint64(block)); err != nil {
+		return err
+	}
+	return s.put(tx, bucketCheckpoints, keyLastBlockHash, []byte(hash))
+}
+
+// PauseReason returns why command execution is paused, or "" if it is not
+func (s *Storage) PauseReason() string {
+	var reason string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketMeta).Get(keyPauseReason) == nil {
+			return fmt.Errorf("pause flag is missing")
+		}
+		v, err := s.get(tx, bucketMeta, keyPauseReason)
+		reason = string(v)
+		return err
+	})
+	if err != nil {
+		// A missing or unreadable pause flag must not silently resume
+		// execution
+		logger.Log.WithError(err).Error("Failed to read pause state")
+		return IntegrityPauseReason
+	}
+	return reason
+}
+
+// Pause persistently pauses command execution until Resume is called
+func (s *Storage) Pause(reason string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, bucketMeta, keyPauseReason, []byte(reason))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save pause: %w", err)
+	}
+	return nil
+}
+
+// Resume clears a pause. The flag is stored empty rather than deleted, so
+// a deleted flag still reads as paused.
+func (s *Storage) Resume() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, bucketMeta, keyPauseReason, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear pause: %w", err)
+	}
+	return nil
+}
+
+// commandKey encodes a command ID as a fixed-width big-endian key, so
+// cursors iterate commands in numeric order
+func commandKey(commandID *big.Int) []byte {
+	return commandID.FillBytes(make([]byte, 32))
+}
+
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
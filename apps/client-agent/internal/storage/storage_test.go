@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/phd/client-agent/internal/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Init("panic", ""); err != nil {
+		panic(err)
+	}
+	if err := logger.InitAudit(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testKey is the state key of test storages
+var testKey = make([]byte, 32)
+
+func openTestStorage(t *testing.T, dir string) *Storage {
+	t.Helper()
+	s, err := NewStorage(dir, testKey)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// raw edits the database the way someone with write access to it could
+func raw(t *testing.T, s *Storage, fn func(tx *bolt.Tx) error) {
+	t.Helper()
+	if err := s.db.Update(fn); err != nil {
+		t.Fatalf("raw update: %v", err)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+
+	if reason := s.PauseReason(); reason != "" {
+		t.Fatalf("new storage paused: %q", reason)
+	}
+	if err := s.Pause("maintenance"); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	s.Close()
+
+	// The pause survives a restart
+	s = openTestStorage(t, dir)
+	if reason := s.PauseReason(); reason != "maintenance" {
+		t.Fatalf("PauseReason after reopen = %q, want maintenance", reason)
+	}
+
+	if err := s.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if reason := s.PauseReason(); reason != "" {
+		t.Fatalf("PauseReason after Resume = %q", reason)
+	}
+}
+
+func TestTamperedPauseFlagStaysPaused(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(tx *bolt.Tx) error
+	}{
+		{"deleted", func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketMeta).Delete(keyPauseReason)
+		}},
+		{"overwritten", func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketMeta).Put(keyPauseReason, []byte("not sealed"))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStorage(t, t.TempDir())
+			if err := s.Pause(IntegrityPauseReason); err != nil {
+				t.Fatalf("Pause: %v", err)
+			}
+
+			raw(t, s, tt.tamper)
+			if reason := s.PauseReason(); reason != IntegrityPauseReason {
+				t.Fatalf("PauseReason = %q, want %q", reason, IntegrityPauseReason)
+			}
+		})
+	}
+}
+
+func TestCheckIntegrityDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(tx *bolt.Tx) error
+	}{
+		{"entry removed", func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketExecuted).Delete(commandKey(big.NewInt(2)))
+		}},
+		{"entry added", func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketExecuted).Put(commandKey(big.NewInt(9)), encodeUint64(1))
+		}},
+		{"entry copied", func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketExecuted)
+			return b.Put(commandKey(big.NewInt(9)), b.Get(commandKey(big.NewInt(1))))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStorage(t, dir)
+			for id := int64(1); id <= 3; id++ {
+				if err := s.MarkExecuted(big.NewInt(id)); err != nil {
+					t.Fatalf("MarkExecuted: %v", err)
+				}
+			}
+
+			// An intact state passes
+			if err := s.CheckIntegrity(); err != nil {
+				t.Fatalf("CheckIntegrity: %v", err)
+			}
+			if reason := s.PauseReason(); reason != "" {
+				t.Fatalf("intact storage paused: %q", reason)
+			}
+
+			// Tampering while the agent runs is caught by the next check
+			raw(t, s, tt.tamper)
+			if err := s.CheckIntegrity(); err != nil {
+				t.Fatalf("CheckIntegrity: %v", err)
+			}
+			if reason := s.PauseReason(); reason != IntegrityPauseReason {
+				t.Fatalf("PauseReason = %q, want %q", reason, IntegrityPauseReason)
+			}
+			if s.IsExecuted(big.NewInt(9)) {
+				t.Fatal("forged entry still counts as executed")
+			}
+
+			// The finding is reported once and stays until resumed
+			if err := s.Resume(); err != nil {
+				t.Fatalf("Resume: %v", err)
+			}
+			s.Close()
+			s = openTestStorage(t, dir)
+			if reason := s.PauseReason(); reason != "" {
+				t.Fatalf("PauseReason after Resume and reopen = %q", reason)
+			}
+		})
+	}
+}
+
+func TestUpgradeFromSchema2KeepsResumedState(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+
+	// A schema 2 database resumed by deleting the pause flag
+	raw(t, s, func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if err := meta.Delete(keyPauseReason); err != nil {
+			return err
+		}
+		return meta.Put(keySchemaVersion, encodeUint64(schemaSealed))
+	})
+	s.Close()
+
+	s = openTestStorage(t, dir)
+	if reason := s.PauseReason(); reason != "" {
+		t.Fatalf("PauseReason after upgrade = %q", reason)
+	}
+}
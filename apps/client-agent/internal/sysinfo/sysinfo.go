@@ -0,0 +1,24 @@
+package sysinfo
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// Collect gathers information about the machine the agent runs on
+func Collect(clientID string) *types.ClientInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return &types.ClientInfo{
+		ClientID:  clientID,
+		OS:        runtime.GOOS,
+		OSVersion: osVersion(),
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+	}
+}
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package sysinfo
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// osVersion returns the macOS product version
+func osVersion() string {
+	out, err := exec.Command("sw_vers", "-productVersion").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return "macOS " + strings.TrimSpace(string(out))
+}
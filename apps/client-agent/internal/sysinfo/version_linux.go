@@ -0,0 +1,33 @@
+//go:build linux
+
+package sysinfo
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// osVersion returns the distribution name from os-release, falling back to
+// the kernel release
+func osVersion() string {
+	for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		return "Linux " + strings.TrimSpace(string(release))
+	}
+	return "unknown"
+}
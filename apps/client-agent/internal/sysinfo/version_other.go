@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package sysinfo
+
+// osVersion is not collected on this platform
+func osVersion() string {
+	return "unknown"
+}
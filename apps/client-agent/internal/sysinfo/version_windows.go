@@ -0,0 +1,17 @@
+//go:build windows
+
+package sysinfo
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// osVersion returns the Windows version string printed by ver
+func osVersion() string {
+	out, err := exec.Command("cmd", "/c", "ver").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
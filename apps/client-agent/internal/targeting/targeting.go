@@ -0,0 +1,95 @@
+package targeting
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/phd/client-agent/pkg/types"
+)
+
+// osAliases maps common OS names to runtime.GOOS values
+var osAliases = map[string]string{
+	"macos": "darwin",
+	"mac":   "darwin",
+	"osx":   "darwin",
+	"win":   "windows",
+}
+
+// Matcher decides whether a command's target selector includes this client
+type Matcher struct {
+	info *types.ClientInfo
+	tags []string
+}
+
+// NewMatcher creates a matcher for a client and its configured group tags
+func NewMatcher(info *types.ClientInfo, tags []string) *Matcher {
+	return &Matcher{info: info, tags: tags}
+}
+
+// Match reports whether target includes this client. When it does not, the
+// returned reason names the first criterion that failed.
+func (m *Matcher) Match(target *types.Target) (bool, string) {
+	if target == nil {
+		return true, ""
+	}
+
+	if len(target.ClientIDs) > 0 && !containsFold(target.ClientIDs, m.info.ClientID) {
+		return false, fmt.Sprintf("client id %q not targeted", m.info.ClientID)
+	}
+
+	if len(target.Groups) > 0 && !m.inAnyGroup(target.Groups) {
+		return false, fmt.Sprintf("none of groups %v targeted", m.tags)
+	}
+
+	if len(target.OS) > 0 && !m.matchesOS(target.OS) {
+		return false, fmt.Sprintf("os %q not targeted", m.info.OS)
+	}
+
+	if len(target.Hostnames) > 0 && !m.matchesHostname(target.Hostnames) {
+		return false, fmt.Sprintf("hostname %q not targeted", m.info.Hostname)
+	}
+
+	return true, ""
+}
+
+func (m *Matcher) inAnyGroup(groups []string) bool {
+	for _, tag := range m.tags {
+		if containsFold(groups, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchesOS(targets []string) bool {
+	for _, t := range targets {
+		t = strings.ToLower(t)
+		if alias, ok := osAliases[t]; ok {
+			t = alias
+		}
+		if t == m.info.OS {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchesHostname(patterns []string) bool {
+	hostname := strings.ToLower(m.info.Hostname)
+	for _, p := range patterns {
+		if ok, err := path.Match(strings.ToLower(p), hostname); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
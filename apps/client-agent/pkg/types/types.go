@@ -17,39 +17,331 @@ const (
 
 // Command represents a blockchain command
 type Command struct {
-	ID          *big.Int
-	CommandType CommandType
-	Data        string
-	Timestamp   *big.Int
-	TriggeredBy string
+	ID               *big.Int
+	CommandType      CommandType
+	Data             string
+	Timestamp        *big.Int
+	TriggeredBy      string
+	BackendCommandID string
+
+	// Envelope and Payload are set when Data carried a command envelope;
+	// Data is then replaced by the payload's data
+	Envelope *Envelope
+	Payload  *Payload
+}
+
+// Envelope wraps a command payload with an optional detached signature. It is
+// stored JSON-encoded in the contract's data field.
+type Envelope struct {
+	Version   int    `json:"v"`
+	Payload   string `json:"payload"` // base64 of the JSON-encoded Payload
+	Algorithm string `json:"alg,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Signature string `json:"sig,omitempty"` // base64
+}
+
+// Payload is the signed content of an envelope. The on-chain command ID is
+// assigned after signing, so the backend command ID identifies the command.
+type Payload struct {
+	BackendCommandID string      `json:"id"`
+	CommandType      CommandType `json:"type"`
+	Data             string      `json:"data"`
+	Timestamp        int64       `json:"timestamp"` // unix seconds at signing
+	Target           *Target     `json:"target,omitempty"`
+	// SHA256 is the hex digest of the body served at a URL command's URL,
+	// so the signature also covers the script it fetches
+	SHA256 string `json:"sha256,omitempty"`
+	// Name labels the script in the execution history, e.g. "lock-screen"
+	Name string `json:"name,omitempty"`
+	// Interpreter overrides the script's shebang, e.g. "python3" or "pwsh"
+	Interpreter string `json:"interpreter,omitempty"`
+	RunAs       RunAs  `json:"runAs,omitempty"`
+	// Limits override the configured default resource limits field by field
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// Limits caps the resources a script may use. Zero means unlimited.
+type Limits struct {
+	MemoryMax    int64 `json:"memoryMax,omitempty"`   // megabytes
+	CPUMax       int   `json:"cpuMax,omitempty"`      // percent of one CPU
+	PidsMax      int64 `json:"pidsMax,omitempty"`     // processes and threads
+	FileSizeMax  int64 `json:"fileSizeMax,omitempty"` // megabytes per file written
+	OpenFilesMax int64 `json:"openFilesMax,omitempty"`
+}
+
+// LimitHit names a resource limit a script ran into
+type LimitHit string
+
+const (
+	// LimitHitMemory means the script was OOM-killed at its memory limit
+	LimitHitMemory LimitHit = "memory"
+	// LimitHitCPU means the script was throttled at its CPU quota
+	LimitHitCPU LimitHit = "cpu"
+	// LimitHitPids means the script was refused a new process or thread
+	LimitHitPids LimitHit = "pids"
+	// LimitHitFileSize means the script was killed for writing a file past its size limit
+	LimitHitFileSize LimitHit = "file-size"
+)
+
+// RunAs selects the account a command's script runs as
+type RunAs string
+
+const (
+	// RunAsDefault runs the script as RUN_AS_USER, or as the agent's own user
+	RunAsDefault RunAs = ""
+	// RunAsDesktop runs the script as the user logged in at the console
+	RunAsDesktop RunAs = "desktop"
+	// RunAsElevated runs the script as the agent's own user. Only scripts in
+	// ELEVATED_SCRIPTS may ask for it.
+	RunAsElevated RunAs = "elevated"
+)
+
+// Target selects which clients run a command. Every non-empty field must
+// match; within a field, any entry may match. An empty target matches all.
+type Target struct {
+	ClientIDs []string `json:"clientIds,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	OS        []string `json:"os,omitempty"`
+	Hostnames []string `json:"hostnames,omitempty"` // glob patterns
+}
+
+// Target returns the command's target selector, or nil if it targets every client
+func (c *Command) Target() *Target {
+	if c.Payload == nil {
+		return nil
+	}
+	return c.Payload.Target
+}
+
+// ContentDigest returns the digest a URL command's fetched body must have,
+// or "" if the payload does not pin one
+func (c *Command) ContentDigest() string {
+	if c.Payload == nil {
+		return ""
+	}
+	return c.Payload.SHA256
+}
+
+// Name returns the script name given by the payload, or ""
+func (c *Command) Name() string {
+	if c.Payload == nil {
+		return ""
+	}
+	return c.Payload.Name
+}
+
+// Interpreter returns the interpreter named by the payload, or "" to pick one
+// from the script
+func (c *Command) Interpreter() string {
+	if c.Payload == nil {
+		return ""
+	}
+	return c.Payload.Interpreter
+}
+
+// Limits returns the payload's resource limits, or nil to use the defaults
+func (c *Command) Limits() *Limits {
+	if c.Payload == nil {
+		return nil
+	}
+	return c.Payload.Limits
+}
+
+// RunAs returns the account the payload asks to run as
+func (c *Command) RunAs() RunAs {
+	if c.Payload == nil {
+		return RunAsDefault
+	}
+	return c.Payload.RunAs
+}
+
+// CommandSourceKind selects where commands are read from
+type CommandSourceKind string
+
+const (
+	// CommandSourceRPC reads the contract through JSON-RPC endpoints
+	CommandSourceRPC CommandSourceKind = "rpc"
+	// CommandSourceMirror reads the contract through the Hedera Mirror Node REST API
+	CommandSourceMirror CommandSourceKind = "mirror"
+	// CommandSourceFile reads command files from a local directory
+	CommandSourceFile CommandSourceKind = "file"
+)
+
+// BackfillPolicy controls which missed commands are executed during reconciliation
+type BackfillPolicy string
+
+const (
+	// BackfillAll executes every missed command in order
+	BackfillAll BackfillPolicy = "all"
+	// BackfillLatest executes only the newest missed command
+	BackfillLatest BackfillPolicy = "latest"
+	// BackfillMaxAge executes missed commands newer than BackfillMaxAge
+	BackfillMaxAge BackfillPolicy = "max-age"
+)
+
+// CommandState is a step in a command's lifecycle. The state is persisted
+// before each transition, so a command interrupted by a crash is recognized
+// on restart.
+type CommandState string
+
+const (
+	// CommandStateReceived means the command was accepted for execution
+	CommandStateReceived CommandState = "received"
+	// CommandStateFetching means the script is being downloaded
+	CommandStateFetching CommandState = "fetching"
+	// CommandStateRunning means the script has been started
+	CommandStateRunning CommandState = "running"
+	// CommandStateSucceeded means the script exited successfully
+	CommandStateSucceeded CommandState = "succeeded"
+	// CommandStateFailed means the command could not be run or the script failed
+	CommandStateFailed CommandState = "failed"
+	// CommandStateAbandoned means the agent stopped while the script was running
+	CommandStateAbandoned CommandState = "abandoned"
+)
+
+// InterruptedPolicy controls commands found running after a restart
+type InterruptedPolicy string
+
+const (
+	// InterruptedAbandon records interrupted commands as abandoned without re-running them
+	InterruptedAbandon InterruptedPolicy = "abandon"
+	// InterruptedRerun runs interrupted commands again
+	InterruptedRerun InterruptedPolicy = "rerun"
+)
+
+// KeySource selects where the state encryption key is read from
+type KeySource string
+
+const (
+	// KeySourceFile reads the key from a file readable only by its owner
+	KeySourceFile KeySource = "file"
+	// KeySourceKeyring reads the key from the Linux kernel keyring
+	KeySourceKeyring KeySource = "keyring"
+	// KeySourceSecretService reads the key from the Secret Service via secret-tool
+	KeySourceSecretService KeySource = "secret-service"
+)
+
+// AdminChange describes an AdminUpdated event
+type AdminChange struct {
+	OldAdmin string
+	NewAdmin string
+	Block    uint64
+	TxHash   string
 }
 
 // ExecutionResult represents the result of a command execution
 type ExecutionResult struct {
-	CommandID   *big.Int
-	Success     bool
-	Output      string
-	Error       string
-	ExecutedAt  time.Time
-	Duration    time.Duration
+	CommandID        *big.Int
+	BackendCommandID string
+	CommandType      CommandType
+	State            CommandState
+	Success          bool
+	ExitCode         int
+	Attempts         int
+	LimitsHit        []LimitHit
+	ScriptName       string
+	ScriptDigest     string // SHA-256 of the script, as in ELEVATED_SCRIPTS
+	Output           string
+	Error            string
+	ExecutedAt       time.Time
+	Duration         time.Duration
 }
 
 // Config represents application configuration
 type Config struct {
 	// Blockchain
+	CommandSource   CommandSourceKind
+	MirrorNodeURL   string
+	CommandDir      string
 	Network         string
 	ContractAddress string
 	RPCURL          string
+	// RPCURLs lists every RPC endpoint, RPCURL first, for failover
+	RPCURLs           []string
+	MaxHeadLag        uint64
+	HeadCheckInterval time.Duration
 
 	// Client
 	ClientID        string
+	Tags            []string
 	PollingInterval time.Duration
-	ExecutionTimeout time.Duration
-	MaxRetryAttempts int
+	// SubscriptionPollInterval is the safety-net polling interval used while
+	// a WebSocket log subscription is live
+	SubscriptionPollInterval time.Duration
+	ExecutionTimeout         time.Duration
+	// KillGracePeriod is the time between SIGTERM and SIGKILL for timed-out scripts
+	KillGracePeriod time.Duration
+	// ScriptLimits are the default resource limits of every script
+	ScriptLimits      Limits
+	MaxRetryAttempts  int
+	MaxCatchupBlocks  uint64
+	LogChunkSize      uint64
+	Confirmations     uint64
+	ReorgRewindBlocks uint64
+
+	// Reconciliation
+	BackfillPolicy    BackfillPolicy
+	BackfillMaxAge    time.Duration
+	ReconcileInterval time.Duration
+	InterruptedPolicy InterruptedPolicy
+
+	// Signing
+	TrustStore      string
+	SignatureMaxAge time.Duration
+
+	// Authorization
+	TriggerAllowlist []string
+	AdminAddresses   []string
+
+	// Script identity
+	RunAsUser  string
+	RunAsGroup string
+	// ElevatedScripts lists SHA-256 digests of scripts that may run as the agent's user
+	ElevatedScripts []string
+
+	// History
+	HistoryMaxAge   time.Duration
+	HistoryMaxCount int
+
+	// Result reporting
+	ReportURL          string
+	ReportSecret       string
+	ReportOutputLimit  int
+	OutboxMaxSize      int64
+	AckContractAddress string
+	AckPrivateKey      string
+
+	// Heartbeat
+	HeartbeatURL      string
+	HeartbeatInterval time.Duration
+
+	// Storage
+	DataDir string
+	// StateDir is DataDir namespaced by network and contract address
+	StateDir       string
+	StateKeySource KeySource
+	StateKeyFile   string
 
 	// Logging
-	LogLevel string
-	LogFile  string
+	LogLevel     string
+	LogFile      string
+	AuditLogFile string
+}
+
+// AgentStatus is a snapshot of a running agent, served on the control socket
+type AgentStatus struct {
+	ClientID        string            `json:"clientId"`
+	Version         string            `json:"version"`
+	PID             int               `json:"pid"`
+	StartedAt       time.Time         `json:"startedAt"`
+	Source          CommandSourceKind `json:"source"`
+	Network         string            `json:"network"`
+	ContractAddress string            `json:"contractAddress,omitempty"`
+	PauseReason     string            `json:"pauseReason,omitempty"`
+	LastCommandID   string            `json:"lastCommandId"`
+	LastBlock       uint64            `json:"lastBlock"`
+	InFlight        int               `json:"inFlight"`
+	PendingReports  int               `json:"pendingReports"`
 }
 
 // ClientInfo represents client system information